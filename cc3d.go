@@ -1,11 +1,9 @@
 package cc3d
 
 import (
-	"compress/gzip"
 	"encoding/xml"
 	"fmt"
 	"io"
-	"strings"
 )
 
 // <map author="supernewton" name="Outside Port" height="12" width="11" background="2">
@@ -48,12 +46,12 @@ type Attributes struct {
 	Name           string `xml:"name,attr"`
 
 	// obsolete attrs?
-	FirstFrame   int    `xml:"first_frame,attr"`
-	CurrentFrame int    `xml:"current_frame,attr"`
-	EditFrame    int    `xml:"edit_frame,attr"`
-	TotalFrames  int    `xml:"total_frames,attr"`
-	FramesPerDir int    `xml:"frames_per_dir,attr"`
-	MapChar      string `xml:"map_char,attr"`
+	FirstFrame   int    `xml:"first_frame,attr,omitempty"`
+	CurrentFrame int    `xml:"current_frame,attr,omitempty"`
+	EditFrame    int    `xml:"edit_frame,attr,omitempty"`
+	TotalFrames  int    `xml:"total_frames,attr,omitempty"`
+	FramesPerDir int    `xml:"frames_per_dir,attr,omitempty"`
+	MapChar      string `xml:"map_char,attr,omitempty"`
 
 	Extra []xml.Attr `xml:",any,attr"`
 }
@@ -69,6 +67,34 @@ func (t Tile) String() string {
 	return fmt.Sprintf("(%d,%d)%s%s", t.X/64, t.Y/64, t.Attributes.Name, extra)
 }
 
+// A Layer is one of the lists of tiles in a map.
+// The name is the name of the corresponding XML element.
+type Layer struct {
+	Name  string
+	Tiles []Tile
+}
+
+// LayerNames lists the names of the tile layers, in the order they appear in level files.
+var LayerNames = []string{"player", "tiles", "objects", "enemies", "blocks", "walls", "switches"}
+
+// Layers returns the tile layers of the map, in the same order as LayerNames.
+func (m *Map) Layers() []Layer {
+	return []Layer{
+		{"player", m.Player},
+		{"tiles", m.Tiles},
+		{"objects", m.Objects},
+		{"enemies", m.Enemies},
+		{"blocks", m.Blocks},
+		{"walls", m.Walls},
+		{"switches", m.Switches},
+	}
+}
+
+// IsLayerName reports whether name is one of LayerNames.
+func IsLayerName(name string) bool {
+	return containsString(LayerNames, name)
+}
+
 func (a Attributes) Equal(x Attributes) bool {
 	return a.Flags == x.Flags &&
 		a.EditorCategory == x.EditorCategory &&
@@ -80,101 +106,66 @@ func (a Attributes) Equal(x Attributes) bool {
 		a.MapChar == x.MapChar
 }
 
-func SearchLevel(m *Map, levelid string) {
-	found := false
-	var names []string
-	countTiles := func(tiles []Tile) {
-		for _, t := range tiles {
-			if t.Type == 0xbf || t.Type == 0xc0 {
-				names = append(names, t.Attributes.Name)
-				found = true
-			}
-		}
-	}
-	countTiles(m.Player)
-	countTiles(m.Tiles)
-	countTiles(m.Objects)
-	countTiles(m.Enemies)
-	countTiles(m.Blocks)
-	countTiles(m.Walls)
-	countTiles(m.Switches)
-
-	if found {
-		fmt.Println(levelid, names)
-	}
-}
-
-type namedReader interface {
-	io.Reader
-	Name() string
-}
-
+// ReadLevel reads a level in CC3D's XML format.
+// The level may be gzipped, and may be in UTF-8, UTF-16, or Windows-1252.
+// Errors are returned as a *ParseError.
 func ReadLevel(r io.Reader) (*Map, error) {
-	var d *xml.Decoder
-	if nr, ok := r.(namedReader); ok && strings.HasSuffix(nr.Name(), ".gz") {
-		zr, err := gzip.NewReader(r)
-		if err != nil {
-			return nil, err
-		}
-		d = xml.NewDecoder(zr)
-	} else {
-		d = xml.NewDecoder(r)
-	}
-
-	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
-		// levels are declared as encoding="utf-16" but are in fact ascii
-		// so install a passthrough CharsetReader function
-		return input, nil
-	}
-	var m *Map
-	if err := d.Decode(&m); err != nil {
-		return nil, err
-	}
-
-	return m, nil
+	return ReadLevelLimits(r, Limits{})
 }
 
 // Check a level for validity.
 // Returns a list of problems found.
 func Check(m *Map) []string {
 	var warnings []string
-	warn := func(msg string, args ...interface{}) {
-		warnings = append(warnings, fmt.Sprintf(msg, args...))
+	for _, d := range Diagnose(m) {
+		warnings = append(warnings, d.Message)
 	}
-	//warn("test")
+	return warnings
+}
+
+// A Diagnostic is a problem found by Diagnose.
+// Problems with a tile record the tile's layer and position;
+// problems with the level as a whole have an empty Layer.
+type Diagnostic struct {
+	Layer   string
+	X, Y    int // tile coordinates (pixels / 64)
+	Message string
+}
+
+// Diagnose checks a level for validity, like Check,
+// but also reports where each problem is.
+func Diagnose(m *Map) []Diagnostic {
+	var diags []Diagnostic
+	warn := func(layer string, t Tile, msg string, args ...interface{}) {
+		diags = append(diags, Diagnostic{layer, t.X / 64, t.Y / 64, fmt.Sprintf(msg, args...)})
+	}
+	//warn("", Tile{}, "test")
 	if !(m.Background == 0 || m.Background == 2) {
-		warn("invalid background: %d", m.Background)
+		warn("", Tile{}, "invalid background: %d", m.Background)
 	}
-	checkTiles := func(tiles []Tile) {
-		for _, t := range tiles {
+	for _, l := range m.Layers() {
+		for _, t := range l.Tiles {
 			if !(0 <= t.X && t.X < m.Width*64) {
-				warn("tile x pos is out of range: x=%d, width=%d", t.X, m.Width)
+				warn(l.Name, t, "tile x pos is out of range: x=%d, width=%d", t.X, m.Width)
 			}
 			if !(t.X%64 == 0) {
-				warn("tile x pos is not a multiple of 64: x=%d", t.X)
+				warn(l.Name, t, "tile x pos is not a multiple of 64: x=%d", t.X)
 			}
 			if !(0 <= t.Y && t.Y < m.Height*64) {
-				warn("tile y pos is out of range: y=%d, height=%d", t.Y, m.Height)
+				warn(l.Name, t, "tile y pos is out of range: y=%d, height=%d", t.Y, m.Height)
 			}
 			if !(t.Y%64 == 0) {
-				warn("tile y pos is not a multiple of 64: y=%d", t.Y)
+				warn(l.Name, t, "tile y pos is not a multiple of 64: y=%d", t.Y)
 			}
 			if !(0 <= t.Direction && t.Direction <= 3) {
-				warn("invalid direction %d", t.Direction)
+				warn(l.Name, t, "invalid direction %d", t.Direction)
 			}
 		}
 	}
-	checkTiles(m.Player)
-	checkTiles(m.Tiles)
-	checkTiles(m.Objects)
-	checkTiles(m.Enemies)
-	checkTiles(m.Blocks)
-	checkTiles(m.Walls)
-	checkTiles(m.Switches)
 
 	for _, name := range m.ExtraElem {
-		warn("ignored top-level element <%s>", name.Local)
+		warn("", Tile{}, "ignored top-level element <%s>", name.Local)
 	}
 
-	return warnings
+	return diags
 }
@@ -0,0 +1,225 @@
+package cc3d
+
+// Compare two levels cell by cell
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type ChangeKind int
+
+const (
+	Added ChangeKind = iota
+	Removed
+	Changed
+)
+
+// A MetaChange is a change to one of the attributes of the <map> element.
+type MetaChange struct {
+	Field    string
+	Old, New string
+}
+
+// A CellChange is a change to a tile at some position in some layer.
+// Old is unset for added tiles, and New is unset for removed tiles.
+type CellChange struct {
+	Kind     ChangeKind
+	Layer    string
+	X, Y     int // tile coordinates
+	Old, New Tile
+}
+
+// A Diff lists the differences between two levels.
+type Diff struct {
+	Meta  []MetaChange
+	Cells []CellChange
+}
+
+// Empty reports whether the levels were identical.
+func (d *Diff) Empty() bool {
+	return len(d.Meta) == 0 && len(d.Cells) == 0
+}
+
+type cellKey struct {
+	layer int
+	x, y  int
+}
+
+// Group a level's tiles by layer and position.
+func (m *Map) cells() map[cellKey][]Tile {
+	cells := make(map[cellKey][]Tile)
+	for i, l := range m.Layers() {
+		for _, t := range l.Tiles {
+			k := cellKey{i, t.X / 64, t.Y / 64}
+			cells[k] = append(cells[k], t)
+		}
+	}
+	return cells
+}
+
+// DiffLevels compares two levels.
+func DiffLevels(a, b *Map) *Diff {
+	d := new(Diff)
+	meta := func(field string, old, new string) {
+		if old != new {
+			d.Meta = append(d.Meta, MetaChange{field, old, new})
+		}
+	}
+	meta("name", a.Name, b.Name)
+	meta("author", a.Author, b.Author)
+	meta("width", strconv.Itoa(a.Width), strconv.Itoa(b.Width))
+	meta("height", strconv.Itoa(a.Height), strconv.Itoa(b.Height))
+	meta("background", strconv.Itoa(a.Background), strconv.Itoa(b.Background))
+
+	ac, bc := a.cells(), b.cells()
+	keys := make(map[cellKey]bool)
+	for k := range ac {
+		keys[k] = true
+	}
+	for k := range bc {
+		keys[k] = true
+	}
+	for k := range keys {
+		d.Cells = append(d.Cells, diffCell(k, ac[k], bc[k])...)
+	}
+	sort.SliceStable(d.Cells, func(i, j int) bool {
+		ci, cj := d.Cells[i], d.Cells[j]
+		if ci.Y != cj.Y {
+			return ci.Y < cj.Y
+		}
+		if ci.X != cj.X {
+			return ci.X < cj.X
+		}
+		return layerIndex(ci.Layer) < layerIndex(cj.Layer)
+	})
+	return d
+}
+
+// Compare the tiles in one cell.
+// Tiles of the same type are paired up first,
+// then any leftover tiles are treated as changing type.
+func diffCell(k cellKey, old, new []Tile) []CellChange {
+	var changes []CellChange
+	layer := LayerNames[k.layer]
+	change := func(kind ChangeKind, o, n Tile) {
+		changes = append(changes, CellChange{kind, layer, k.x, k.y, o, n})
+	}
+	used := make([]bool, len(new))
+	var leftover []Tile
+outer:
+	for _, o := range old {
+		for j, n := range new {
+			if !used[j] && n.Type == o.Type {
+				used[j] = true
+				if !sameTile(o, n) {
+					change(Changed, o, n)
+				}
+				continue outer
+			}
+		}
+		leftover = append(leftover, o)
+	}
+	for j, n := range new {
+		if used[j] {
+			continue
+		}
+		if len(leftover) > 0 {
+			change(Changed, leftover[0], n)
+			leftover = leftover[1:]
+		} else {
+			change(Added, Tile{}, n)
+		}
+	}
+	for _, o := range leftover {
+		change(Removed, o, Tile{})
+	}
+	return changes
+}
+
+func sameTile(a, b Tile) bool {
+	return a.Type == b.Type &&
+		a.Direction == b.Direction &&
+		a.ImageIndex == b.ImageIndex &&
+		a.X == b.X && a.Y == b.Y &&
+		a.Attributes.Equal(b.Attributes)
+}
+
+func layerIndex(name string) int {
+	for i, v := range LayerNames {
+		if v == name {
+			return i
+		}
+	}
+	return len(LayerNames)
+}
+
+// Details describes what changed about a tile.
+func (c CellChange) Details() []string {
+	var s []string
+	o, n := c.Old, c.New
+	if o.Type != n.Type {
+		s = append(s, fmt.Sprintf("type %d %s -> %d %s", o.Type, o.Attributes.Name, n.Type, n.Attributes.Name))
+	} else if o.Attributes.Name != n.Attributes.Name {
+		s = append(s, fmt.Sprintf("name %q -> %q", o.Attributes.Name, n.Attributes.Name))
+	}
+	if o.Direction != n.Direction {
+		s = append(s, fmt.Sprintf("direction %d -> %d", o.Direction, n.Direction))
+	}
+	if o.ImageIndex != n.ImageIndex {
+		s = append(s, fmt.Sprintf("image_index %d -> %d", o.ImageIndex, n.ImageIndex))
+	}
+	if o.X != n.X || o.Y != n.Y {
+		s = append(s, fmt.Sprintf("position (%d,%d) -> (%d,%d)", o.X, o.Y, n.X, n.Y))
+	}
+	oa, na := o.Attributes, n.Attributes
+	if oa.Flags != na.Flags {
+		s = append(s, fmt.Sprintf("flags %#x -> %#x", oa.Flags, na.Flags))
+	}
+	if oa.EditorCategory != na.EditorCategory {
+		s = append(s, fmt.Sprintf("editor_category %d -> %d", oa.EditorCategory, na.EditorCategory))
+	}
+	if oa.FirstFrame != na.FirstFrame || oa.EditFrame != na.EditFrame ||
+		oa.TotalFrames != na.TotalFrames || oa.FramesPerDir != na.FramesPerDir {
+		s = append(s, "animation frames")
+	}
+	if oa.MapChar != na.MapChar {
+		s = append(s, fmt.Sprintf("map_char %q -> %q", oa.MapChar, na.MapChar))
+	}
+	return s
+}
+
+func (c CellChange) String() string {
+	pos := fmt.Sprintf("(%d,%d) %s", c.X, c.Y, c.Layer)
+	switch c.Kind {
+	case Added:
+		return fmt.Sprintf("+ %s: %d %s dir=%d", pos, c.New.Type, c.New.Attributes.Name, c.New.Direction)
+	case Removed:
+		return fmt.Sprintf("- %s: %d %s dir=%d", pos, c.Old.Type, c.Old.Attributes.Name, c.Old.Direction)
+	default:
+		return fmt.Sprintf("~ %s: %d %s: %s", pos, c.Old.Type, c.Old.Attributes.Name, strings.Join(c.Details(), ", "))
+	}
+}
+
+// WriteTo writes the diff in a human-readable text format.
+func (d *Diff) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	for _, c := range d.Meta {
+		n, err := fmt.Fprintf(w, "%s: %q -> %q\n", c.Field, c.Old, c.New)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	for _, c := range d.Cells {
+		n, err := fmt.Fprintln(w, c)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,77 @@
+package cc3d
+
+import (
+	"bytes"
+	"testing"
+)
+
+func named(t Tile, name string) Tile {
+	t.Attributes.Name = name
+	return t
+}
+
+func TestDiffLevels(t *testing.T) {
+	a := &Map{
+		Name:    "Level",
+		Width:   2,
+		Height:  2,
+		Tiles:   []Tile{named(tile(0, 0, 2, 0), "Wall")},
+		Objects: []Tile{named(tile(1, 0, 38, 0), "Red Key")},
+		Enemies: []Tile{named(tile(1, 1, 51, 0), "Snappy")},
+	}
+	b := &Map{
+		Name:   "Level",
+		Width:  3,
+		Height: 2,
+		Tiles: []Tile{
+			named(tile(0, 0, 3, 0), "Ice"),
+			named(tile(2, 0, 1, 0), "Floor"),
+		},
+		Enemies: []Tile{named(tile(1, 1, 51, 2), "Snappy")},
+	}
+	d := DiffLevels(a, b)
+
+	if len(d.Meta) != 1 || d.Meta[0] != (MetaChange{"width", "2", "3"}) {
+		t.Errorf("Meta = %v, want the width to change from 2 to 3", d.Meta)
+	}
+	want := []struct {
+		kind  ChangeKind
+		layer string
+		x, y  int
+	}{
+		{Changed, "tiles", 0, 0},
+		{Removed, "objects", 1, 0},
+		{Added, "tiles", 2, 0},
+		{Changed, "enemies", 1, 1},
+	}
+	if len(d.Cells) != len(want) {
+		t.Fatalf("got %d cell changes, want %d:\n%v", len(d.Cells), len(want), d.Cells)
+	}
+	for i, w := range want {
+		c := d.Cells[i]
+		if c.Kind != w.kind || c.Layer != w.layer || c.X != w.x || c.Y != w.y {
+			t.Errorf("change %d: got %v at (%d,%d) in %s, want %v at (%d,%d) in %s", i, c.Kind, c.X, c.Y, c.Layer, w.kind, w.x, w.y, w.layer)
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := d.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	wantText := `width: "2" -> "3"
+~ (0,0) tiles: 2 Wall: type 2 Wall -> 3 Ice
+- (1,0) objects: 38 Red Key dir=0
++ (2,0) tiles: 1 Floor dir=0
+~ (1,1) enemies: 51 Snappy: direction 0 -> 2
+`
+	if got := buf.String(); got != wantText {
+		t.Errorf("WriteTo wrote:\n%s\nwant:\n%s", got, wantText)
+	}
+}
+
+func TestDiffLevelsIdentical(t *testing.T) {
+	d := DiffLevels(turnLevel(), turnLevel())
+	if !d.Empty() {
+		t.Errorf("identical levels have differences: %v %v", d.Meta, d.Cells)
+	}
+}
@@ -0,0 +1,178 @@
+package cc3d
+
+// Character encoding detection.
+//
+// Levels are declared as encoding="utf-16", but most of them are in fact ASCII.
+// Some are real UTF-16 (with or without a byte order mark),
+// and some have names in Windows-1252 or UTF-8.
+// We convert everything to UTF-8 before handing it to the XML decoder.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Wrap a level file so that it reads as UTF-8,
+// decompressing it first if it is gzipped.
+func decodeInput(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, gzipMagic) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		br = bufio.NewReader(zr)
+	}
+	head, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(head, []byte{0xef, 0xbb, 0xbf}):
+		br.Discard(3)
+		return newLatin1FallbackReader(br), nil
+	case bytes.HasPrefix(head, []byte{0xff, 0xfe}):
+		br.Discard(2)
+		return newUTF16Reader(br, false), nil
+	case bytes.HasPrefix(head, []byte{0xfe, 0xff}):
+		br.Discard(2)
+		return newUTF16Reader(br, true), nil
+	case bytes.HasPrefix(head, []byte{'<', 0, '?', 0}):
+		return newUTF16Reader(br, false), nil
+	case bytes.HasPrefix(head, []byte{0, '<', 0, '?'}):
+		return newUTF16Reader(br, true), nil
+	}
+	return newLatin1FallbackReader(br), nil
+}
+
+// A charset reader for xml.Decoder.
+// By the time the decoder sees the input, decodeInput has already converted it to UTF-8,
+// so whatever encoding the document declares we just pass it through.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "utf-16", "utf-16le", "utf-16be", "unicode",
+		"iso-8859-1", "latin1", "latin-1", "windows-1252", "cp1252",
+		"us-ascii", "ascii":
+		return input, nil
+	}
+	return nil, fmt.Errorf("unsupported charset %q", charset)
+}
+
+// utf16Reader converts UTF-16 to UTF-8.
+type utf16Reader struct {
+	r         *bufio.Reader
+	bigEndian bool
+	buf       []byte // decoded but unread bytes
+	err       error
+}
+
+func newUTF16Reader(r *bufio.Reader, bigEndian bool) io.Reader {
+	return &utf16Reader{r: r, bigEndian: bigEndian}
+}
+
+func (u *utf16Reader) readUnit() (uint16, error) {
+	var b [2]byte
+	if _, err := io.ReadFull(u.r, b[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("utf-16: odd number of bytes")
+		}
+		return 0, err
+	}
+	if u.bigEndian {
+		return uint16(b[0])<<8 | uint16(b[1]), nil
+	}
+	return uint16(b[1])<<8 | uint16(b[0]), nil
+}
+
+func (u *utf16Reader) Read(p []byte) (int, error) {
+	for len(u.buf) < len(p) && u.err == nil {
+		c, err := u.readUnit()
+		if err != nil {
+			u.err = err
+			break
+		}
+		r := rune(c)
+		if utf16.IsSurrogate(r) {
+			c2, err := u.readUnit()
+			if err != nil {
+				u.err = err
+				r = utf8.RuneError
+			} else {
+				r = utf16.DecodeRune(r, rune(c2))
+			}
+		}
+		u.buf = appendRune(u.buf, r)
+	}
+	n := copy(p, u.buf)
+	u.buf = u.buf[n:]
+	if n == 0 && u.err != nil {
+		return 0, u.err
+	}
+	return n, nil
+}
+
+func appendRune(b []byte, r rune) []byte {
+	var tmp [utf8.UTFMax]byte
+	n := utf8.EncodeRune(tmp[:], r)
+	return append(b, tmp[:n]...)
+}
+
+// latin1FallbackReader passes through valid UTF-8,
+// and converts any bytes which aren't valid UTF-8 from Windows-1252.
+type latin1FallbackReader struct {
+	r   *bufio.Reader
+	buf []byte
+	err error
+}
+
+func newLatin1FallbackReader(r *bufio.Reader) io.Reader {
+	return &latin1FallbackReader{r: r}
+}
+
+func (l *latin1FallbackReader) Read(p []byte) (int, error) {
+	for len(l.buf) < len(p) && l.err == nil {
+		b, err := l.r.ReadByte()
+		if err != nil {
+			l.err = err
+			break
+		}
+		if b < utf8.RuneSelf {
+			l.buf = append(l.buf, b)
+			continue
+		}
+		l.r.UnreadByte()
+		// Peek at the longest possible sequence; at the end of the input we may get less
+		seq, _ := l.r.Peek(utf8.UTFMax)
+		if r, size := utf8.DecodeRune(seq); r != utf8.RuneError || size > 1 {
+			l.buf = append(l.buf, seq[:size]...)
+			l.r.Discard(size)
+			continue
+		}
+		l.r.Discard(1)
+		l.buf = appendRune(l.buf, decodeWindows1252(b))
+	}
+	n := copy(p, l.buf)
+	l.buf = l.buf[n:]
+	if n == 0 && l.err != nil {
+		return 0, l.err
+	}
+	return n, nil
+}
+
+// Windows-1252 differs from Latin-1 in the range 0x80-0x9f
+var windows1252 = [32]rune{
+	'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8d, 'Ž', 0x8f,
+	0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9d, 'ž', 'Ÿ',
+}
+
+func decodeWindows1252(b byte) rune {
+	if 0x80 <= b && b < 0xa0 {
+		return windows1252[b-0x80]
+	}
+	return rune(b)
+}
@@ -0,0 +1,87 @@
+package cc3d
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+func encodingLevel(name string) string {
+	return `<?xml version="1.0" encoding="utf-16"?>` + "\n" +
+		`<map author="someone" name="` + name + `" height="1" width="1" background="0"><tiles /></map>` + "\n"
+}
+
+func encodeUTF16(s string, bigEndian bool) []byte {
+	var b []byte
+	for _, c := range utf16.Encode([]rune(s)) {
+		if bigEndian {
+			b = append(b, byte(c>>8), byte(c))
+		} else {
+			b = append(b, byte(c), byte(c>>8))
+		}
+	}
+	return b
+}
+
+func gzipBytes(b []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(b)
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestReadLevelEncodings(t *testing.T) {
+	const name = "Café ★ 𝄞"
+	utf8Level := []byte(encodingLevel(name))
+	utf16LE := encodeUTF16(encodingLevel(name), false)
+	utf16BE := encodeUTF16(encodingLevel(name), true)
+	tests := []struct {
+		desc  string
+		input []byte
+		want  string
+	}{
+		{"ascii", []byte(encodingLevel("Plain")), "Plain"},
+		{"utf-8", utf8Level, name},
+		{"utf-8 bom", append([]byte{0xef, 0xbb, 0xbf}, utf8Level...), name},
+		{"utf-16le", utf16LE, name},
+		{"utf-16le bom", append([]byte{0xff, 0xfe}, utf16LE...), name},
+		{"utf-16be", utf16BE, name},
+		{"utf-16be bom", append([]byte{0xfe, 0xff}, utf16BE...), name},
+		{"windows-1252", []byte(encodingLevel("Caf\xe9 \x93quoted\x94 \x80")), "Café “quoted” €"},
+		{"mixed", []byte(encodingLevel("Caf\xe9 ★")), "Café ★"},
+		{"gzip", gzipBytes(utf8Level), name},
+		{"gzip utf-16le bom", gzipBytes(append([]byte{0xff, 0xfe}, utf16LE...)), name},
+		{"gzip windows-1252", gzipBytes([]byte(encodingLevel("Caf\xe9"))), "Café"},
+	}
+	for _, tt := range tests {
+		m, err := ReadLevel(bytes.NewReader(tt.input))
+		if err != nil {
+			t.Errorf("%s: %v", tt.desc, err)
+			continue
+		}
+		if m.Name != tt.want || m.Author != "someone" || m.Width != 1 {
+			t.Errorf("%s: got name %q, author %q, width %d; want name %q", tt.desc, m.Name, m.Author, m.Width, tt.want)
+		}
+	}
+}
+
+func TestReadLevelBadEncoding(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input []byte
+		err   string
+	}{
+		{"odd utf-16", append([]byte{0xff, 0xfe}, encodeUTF16(encodingLevel("x"), false)[1:]...), "utf-16"},
+		{"truncated gzip", gzipBytes([]byte(encodingLevel("x")))[:20], "unexpected EOF"},
+		{"unknown charset", []byte(strings.Replace(encodingLevel("x"), "utf-16", "shift_jis", 1)), "charset"},
+	}
+	for _, tt := range tests {
+		_, err := ReadLevel(bytes.NewReader(tt.input))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got error %v, want one mentioning %q", tt.desc, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package cc3d
+
+// Level fingerprints, for finding duplicate and near-duplicate levels.
+//
+// A fingerprint only looks at the cell grid: the type and direction of
+// every tile. Level names, authors, and tile attributes are ignored,
+// so renamed copies of a level have the same fingerprint.
+//
+// Similarity is estimated with MinHash over 2x2 windows of cells.
+// Since windows are position independent, small edits and shifted copies
+// only change a few windows. Rotations and reflections are handled by
+// computing a signature for each of the eight orientations of the grid.
+// Tiles which point somewhere, either by their direction or by their type
+// (like force floors and ice corners), are turned along with the grid.
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+)
+
+const sigSize = 64 // number of MinHash values per signature
+
+// Levels larger than this in either dimension get an empty fingerprint.
+const maxFingerprintSize = 256
+
+// A Fingerprint summarizes the layout of a level.
+type Fingerprint struct {
+	// Hash of the cell grid. Levels with the same hash
+	// have the same tiles in the same places.
+	Hash [sha256.Size]byte
+
+	// MinHash signatures of each orientation of the level:
+	// rotated 0, 90, 180, and 270 degrees clockwise,
+	// then the same for the level mirrored left to right.
+	Sig [8][sigSize]uint32
+}
+
+// A cellGrid holds a hash of the tile stack at each position of a level.
+type cellGrid struct {
+	w, h  int
+	cells []uint64
+}
+
+// Fingerprint computes the fingerprint of a level.
+// Levels with an invalid or very large size get an empty fingerprint,
+// which isn't similar to anything.
+func (m *Map) Fingerprint() *Fingerprint {
+	fp := new(Fingerprint)
+	if m.Width <= 0 || m.Height <= 0 || m.Width > maxFingerprintSize || m.Height > maxFingerprintSize {
+		return fp
+	}
+	g := m.cellGrid(0, false)
+	h := sha256.New()
+	var buf [8]byte
+	binary.LittleEndian.PutUint32(buf[0:], uint32(g.w))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(g.h))
+	h.Write(buf[:])
+	for _, c := range g.cells {
+		binary.LittleEndian.PutUint64(buf[:], c)
+		h.Write(buf[:])
+	}
+	h.Sum(fp.Hash[:0])
+
+	fp.Sig[0] = g.signature()
+	for r := 1; r < 8; r++ {
+		fp.Sig[r] = m.cellGrid(r%4, r >= 4).signature()
+	}
+	return fp
+}
+
+// Reports whether the fingerprint is missing or empty.
+func (fp *Fingerprint) empty() bool {
+	return fp == nil || fp.Hash == [sha256.Size]byte{}
+}
+
+// Tile types which differ only in which way they face,
+// in clockwise order starting from up (or the upper right corner).
+var turningTypes = [][4]int{
+	{10, 11, 12, 13},     // force floors N, E, S, W
+	{147, 148, 149, 150}, // panels up, right, down, left
+	{4, 5, 7, 6},         // ice corners with walls on the NE, SE, SW, and NW
+	{184, 186, 187, 185}, // reflectors LU, UR, RD, DL
+}
+
+// For each of turningTypes, the position in the list of the type's mirror image.
+var mirrorTypes = [][4]int{
+	{0, 3, 2, 1}, // E <-> W
+	{0, 3, 2, 1},
+	{3, 2, 1, 0}, // NE <-> NW, SE <-> SW
+	{1, 0, 3, 2}, // LU <-> UR, RD <-> DL
+}
+
+// Turn a tile clockwise by rot quarter turns.
+func rotateTile(typ, dir, rot int) (int, int) {
+	if HasDirection(typ) {
+		dir = (dir + rot) % 4
+	}
+	for _, types := range turningTypes {
+		for i, t := range types {
+			if t == typ {
+				return types[(i+rot)%4], dir
+			}
+		}
+	}
+	return typ, dir
+}
+
+// Mirror a tile left to right.
+func mirrorTile(typ, dir int) (int, int) {
+	if HasDirection(typ) && dir%2 == 1 {
+		dir = 4 - dir // east <-> west
+	}
+	for k, types := range turningTypes {
+		for i, t := range types {
+			if t == typ {
+				return types[mirrorTypes[k][i]], dir
+			}
+		}
+	}
+	return typ, dir
+}
+
+// Compute the cell grid of the level, mirrored left to right if mirror is set,
+// and then rotated clockwise by rot quarter turns.
+// Tiles are turned along with the grid.
+// The level's size must already have been checked.
+func (m *Map) cellGrid(rot int, mirror bool) cellGrid {
+	w, h := m.Width, m.Height
+	if rot%2 == 1 {
+		w, h = h, w
+	}
+	stacks := make([][]uint64, w*h)
+	for _, l := range m.Layers() {
+		for _, t := range l.Tiles {
+			if t.X < 0 || t.Y < 0 {
+				continue
+			}
+			x, y := t.X/64, t.Y/64
+			if x >= m.Width || y >= m.Height {
+				continue
+			}
+			typ, dir := t.Type, t.Direction
+			if mirror {
+				x = m.Width - 1 - x
+				typ, dir = mirrorTile(typ, dir)
+			}
+			for i := 0; i < rot; i++ {
+				// (x, y) -> (H-1-y, x) where H is the height before this turn
+				hh := m.Height
+				if i%2 == 1 {
+					hh = m.Width
+				}
+				x, y = hh-1-y, x
+			}
+			typ, dir = rotateTile(typ, dir, rot)
+			i := y*w + x
+			stacks[i] = append(stacks[i], uint64(typ)<<8|uint64(dir&0xff))
+		}
+	}
+	g := cellGrid{w: w, h: h, cells: make([]uint64, w*h)}
+	for i, s := range stacks {
+		sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+		v := uint64(0)
+		for _, t := range s {
+			v = mix64(v ^ t)
+		}
+		g.cells[i] = v
+	}
+	return g
+}
+
+// Compute the MinHash signature of the 2x2 windows of a grid.
+// Repeated windows are counted separately, so that
+// the signature reflects how common each window is.
+func (g cellGrid) signature() [sigSize]uint32 {
+	var sig [sigSize]uint32
+	for i := range sig {
+		sig[i] = ^uint32(0)
+	}
+	seen := make(map[uint64]uint64)
+	for y := 0; y+1 < g.h; y++ {
+		for x := 0; x+1 < g.w; x++ {
+			i := y*g.w + x
+			v := mix64(g.cells[i])
+			v = mix64(v ^ g.cells[i+1])
+			v = mix64(v ^ g.cells[i+g.w])
+			v = mix64(v ^ g.cells[i+g.w+1])
+			n := seen[v]
+			seen[v] = n + 1
+			v = mix64(v + n)
+			for k := range sig {
+				if hk := uint32(mix64(v^sigSeeds[k]) >> 32); hk < sig[k] {
+					sig[k] = hk
+				}
+			}
+		}
+	}
+	return sig
+}
+
+var sigSeeds = func() (s [sigSize]uint64) {
+	for i := range s {
+		s[i] = mix64(uint64(i) + 1)
+	}
+	return s
+}()
+
+// The splitmix64 finalizer.
+func mix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// Similarity estimates how similar two levels are,
+// from 0 (nothing in common) to 1 (identical, possibly rotated or mirrored).
+func Similarity(a, b *Fingerprint) float64 {
+	if a.empty() || b.empty() {
+		return 0
+	}
+	if a.Hash == b.Hash {
+		return 1
+	}
+	best := 0
+	for r := range b.Sig {
+		n := 0
+		for k := range a.Sig[0] {
+			if a.Sig[0][k] == b.Sig[r][k] {
+				n++
+			}
+		}
+		if n > best {
+			best = n
+		}
+	}
+	return float64(best) / sigSize
+}
+
+// Cluster groups fingerprints whose similarity is at least threshold.
+// Similarity is treated as transitive, so two levels in the same cluster
+// may be less similar than the threshold if there is a chain of similar levels between them.
+// Returns a list of clusters, each of which is a list of indexes into fps.
+// Levels which aren't similar to any other level are omitted,
+// as are nil and empty fingerprints.
+func Cluster(fps []*Fingerprint, threshold float64) [][]int {
+	parent := make([]int, len(fps))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	// Locality sensitive hashing: split the signatures into bands
+	// and only compare levels which share at least one band.
+	const bands = 16
+	const rows = sigSize / bands
+	type bandKey struct {
+		band int
+		hash uint64
+	}
+	buckets := make(map[bandKey][]int)
+	bandHash := func(sig *[sigSize]uint32, b int) uint64 {
+		v := uint64(b)
+		for _, x := range sig[b*rows : (b+1)*rows] {
+			v = mix64(v ^ uint64(x))
+		}
+		return v
+	}
+	for i, fp := range fps {
+		if fp.empty() {
+			continue
+		}
+		for b := 0; b < bands; b++ {
+			k := bandKey{b, bandHash(&fp.Sig[0], b)}
+			buckets[k] = append(buckets[k], i)
+		}
+	}
+	type pair struct{ i, j int }
+	compared := make(map[pair]bool)
+	for i, fp := range fps {
+		if fp.empty() {
+			continue
+		}
+		for r := range fp.Sig {
+			for b := 0; b < bands; b++ {
+				for _, j := range buckets[bandKey{b, bandHash(&fp.Sig[r], b)}] {
+					p := pair{i, j}
+					if j < i {
+						p = pair{j, i}
+					}
+					if i == j || compared[p] {
+						continue
+					}
+					compared[p] = true
+					if Similarity(fps[p.i], fps[p.j]) >= threshold {
+						parent[find(p.i)] = find(p.j)
+					}
+				}
+			}
+		}
+	}
+	// Exact duplicates always go together, even if their signatures are
+	// degenerate (say, for levels smaller than 2x2).
+	byHash := make(map[[sha256.Size]byte]int)
+	for i, fp := range fps {
+		if fp.empty() {
+			continue
+		}
+		if j, ok := byHash[fp.Hash]; ok {
+			parent[find(i)] = find(j)
+		} else {
+			byHash[fp.Hash] = i
+		}
+	}
+
+	groups := make(map[int][]int)
+	for i := range fps {
+		root := find(i)
+		groups[root] = append(groups[root], i)
+	}
+	var clusters [][]int
+	for _, g := range groups {
+		if len(g) > 1 {
+			clusters = append(clusters, g)
+		}
+	}
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i][0] < clusters[j][0] })
+	return clusters
+}
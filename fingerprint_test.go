@@ -0,0 +1,124 @@
+package cc3d
+
+import "testing"
+
+func tile(x, y, typ, dir int) Tile {
+	return Tile{X: x * 64, Y: y * 64, Type: typ, Direction: dir}
+}
+
+// A 3x2 level with tiles which face different ways:
+//
+//	force floor N   ice corner NE   reflector LU
+//	panel up        Snappy east     wall
+func turnLevel() *Map {
+	return &Map{
+		Width:  3,
+		Height: 2,
+		Tiles: []Tile{
+			tile(0, 0, 10, 0),
+			tile(1, 0, 4, 0),
+			tile(2, 0, 184, 0),
+			tile(2, 1, 2, 0),
+		},
+		Walls:   []Tile{tile(0, 1, 147, 0)},
+		Enemies: []Tile{tile(1, 1, 51, 1)},
+	}
+}
+
+func TestFingerprintRotated(t *testing.T) {
+	// turnLevel rotated 90 degrees clockwise
+	rotated := &Map{
+		Width:  2,
+		Height: 3,
+		Tiles: []Tile{
+			tile(1, 0, 11, 0),  // force floor E
+			tile(1, 1, 5, 0),   // ice corner SE
+			tile(1, 2, 186, 0), // reflector UR
+			tile(0, 2, 2, 0),
+		},
+		Walls:   []Tile{tile(0, 0, 148, 1)}, // panel right
+		Enemies: []Tile{tile(0, 1, 51, 2)},  // Snappy south
+	}
+	a, b := turnLevel().Fingerprint(), rotated.Fingerprint()
+	if a.Hash == b.Hash {
+		t.Errorf("rotated level has the same hash")
+	}
+	if sim := Similarity(a, b); sim != 1 {
+		t.Errorf("Similarity(level, rotated) = %v, want 1", sim)
+	}
+	if sim := Similarity(b, a); sim != 1 {
+		t.Errorf("Similarity(rotated, level) = %v, want 1", sim)
+	}
+}
+
+func TestFingerprintMirrored(t *testing.T) {
+	// turnLevel mirrored left to right
+	mirrored := &Map{
+		Width:  3,
+		Height: 2,
+		Tiles: []Tile{
+			tile(2, 0, 10, 0),  // force floor N
+			tile(1, 0, 6, 0),   // ice corner NW
+			tile(0, 0, 186, 0), // reflector UR
+			tile(0, 1, 2, 0),
+		},
+		Walls:   []Tile{tile(2, 1, 147, 0)}, // panel up
+		Enemies: []Tile{tile(1, 1, 51, 3)},  // Snappy west
+	}
+	if sim := Similarity(turnLevel().Fingerprint(), mirrored.Fingerprint()); sim != 1 {
+		t.Errorf("Similarity(level, mirrored) = %v, want 1", sim)
+	}
+}
+
+func TestFingerprintTurnsTypes(t *testing.T) {
+	// Moving the tiles without turning them isn't a rotation
+	moved := &Map{
+		Width:  2,
+		Height: 3,
+		Tiles: []Tile{
+			tile(1, 0, 10, 0),
+			tile(1, 1, 4, 0),
+			tile(1, 2, 184, 0),
+			tile(0, 2, 2, 0),
+		},
+		Walls:   []Tile{tile(0, 0, 147, 1)},
+		Enemies: []Tile{tile(0, 1, 51, 2)},
+	}
+	if sim := Similarity(turnLevel().Fingerprint(), moved.Fingerprint()); sim == 1 {
+		t.Errorf("level with unturned tiles has similarity 1")
+	}
+}
+
+func TestRotateTileCycles(t *testing.T) {
+	for typ := range tileNames {
+		for dir := 0; dir < 4; dir++ {
+			if gt, gd := rotateTile(typ, dir, 4); gt != typ || gd != dir {
+				t.Errorf("four turns of %d dir %d gave %d dir %d", typ, dir, gt, gd)
+			}
+			mt, md := mirrorTile(typ, dir)
+			if gt, gd := mirrorTile(mt, md); gt != typ || gd != dir {
+				t.Errorf("mirroring %d dir %d twice gave %d dir %d", typ, dir, gt, gd)
+			}
+		}
+	}
+}
+
+func TestFingerprintInvalidSize(t *testing.T) {
+	var fps []*Fingerprint
+	for _, m := range []*Map{
+		{Width: 0, Height: 5},
+		{Width: -3, Height: 5},
+		{Width: 300, Height: 300},
+	} {
+		fp := m.Fingerprint()
+		if !fp.empty() {
+			t.Errorf("%dx%d level has a non-empty fingerprint", m.Width, m.Height)
+		}
+		fps = append(fps, fp)
+	}
+	fps = append(fps, nil, turnLevel().Fingerprint(), turnLevel().Fingerprint())
+	clusters := Cluster(fps, 0.8)
+	if len(clusters) != 1 || len(clusters[0]) != 2 || clusters[0][0] != 4 {
+		t.Errorf("Cluster = %v, want [[4 5]]", clusters)
+	}
+}
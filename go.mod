@@ -1,6 +1,6 @@
 module github.com/magical/cc3d
 
-go 1.13
+go 1.19
 
 require (
 	github.com/juju/naturalsort v0.0.0-20180423034842-5b81707e882b
@@ -0,0 +1,184 @@
+package cc3d
+
+// Three-way merge of levels
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// A Conflict is a cell or level attribute which was changed differently on both sides of a merge.
+// For cell conflicts, Field is empty and the tile fields are set.
+type Conflict struct {
+	Field              string // for <map> attribute conflicts
+	Layer              string
+	X, Y               int
+	Base, Ours, Theirs []Tile
+	OursValue          string
+	TheirsValue        string
+}
+
+func (c Conflict) String() string {
+	if c.Field != "" {
+		return fmt.Sprintf("%s: ours %q, theirs %q", c.Field, c.OursValue, c.TheirsValue)
+	}
+	return fmt.Sprintf("(%d,%d) %s: base %s, ours %s, theirs %s", c.X, c.Y, c.Layer, tileList(c.Base), tileList(c.Ours), tileList(c.Theirs))
+}
+
+func tileList(tiles []Tile) string {
+	if len(tiles) == 0 {
+		return "[]"
+	}
+	s := "["
+	for i, t := range tiles {
+		if i > 0 {
+			s += " "
+		}
+		s += fmt.Sprintf("%d:%s/dir=%d", t.Type, t.Attributes.Name, t.Direction)
+	}
+	return s + "]"
+}
+
+// Merge combines the changes made to base in ours and theirs.
+// Changes to different cells (or different layers of the same cell) are merged automatically.
+// If both sides changed the same cell in different ways, the cell is reported
+// as a conflict and the merged level keeps our version of it.
+func Merge(base, ours, theirs *Map) (*Map, []Conflict) {
+	var conflicts []Conflict
+	merged := new(Map)
+	*merged = *ours
+
+	mergeField := func(field string, b, o, t string) string {
+		switch {
+		case o == b || o == t:
+			return t
+		case t == b:
+			return o
+		}
+		conflicts = append(conflicts, Conflict{Field: field, OursValue: o, TheirsValue: t})
+		return o
+	}
+	mergeInt := func(field string, b, o, t int) int {
+		v := mergeField(field, strconv.Itoa(b), strconv.Itoa(o), strconv.Itoa(t))
+		n, _ := strconv.Atoi(v)
+		return n
+	}
+	merged.Name = mergeField("name", base.Name, ours.Name, theirs.Name)
+	merged.Author = mergeField("author", base.Author, ours.Author, theirs.Author)
+	merged.Width = mergeInt("width", base.Width, ours.Width, theirs.Width)
+	merged.Height = mergeInt("height", base.Height, ours.Height, theirs.Height)
+	merged.Background = mergeInt("background", base.Background, ours.Background, theirs.Background)
+
+	bc, oc, tc := base.cells(), ours.cells(), theirs.cells()
+	keys := make(map[cellKey]bool)
+	for _, cells := range []map[cellKey][]Tile{bc, oc, tc} {
+		for k := range cells {
+			keys[k] = true
+		}
+	}
+	result := make(map[cellKey][]Tile)
+	for k := range keys {
+		b, o, t := bc[k], oc[k], tc[k]
+		switch {
+		case sameStack(o, b) || sameStack(o, t):
+			result[k] = t
+		case sameStack(t, b):
+			result[k] = o
+		default:
+			conflicts = append(conflicts, Conflict{
+				Layer: LayerNames[k.layer],
+				X:     k.x, Y: k.y,
+				Base: b, Ours: o, Theirs: t,
+			})
+			result[k] = o
+		}
+	}
+
+	// Rebuild the layers, keeping the tiles in the same order as ours where possible.
+	// Cells which didn't exist in ours go at the end.
+	layers := make([][]Tile, len(LayerNames))
+	for i, l := range ours.Layers() {
+		done := make(map[cellKey]bool)
+		for _, t := range l.Tiles {
+			k := cellKey{i, t.X / 64, t.Y / 64}
+			if !done[k] {
+				layers[i] = append(layers[i], result[k]...)
+				done[k] = true
+			}
+		}
+		var rest []cellKey
+		for k := range result {
+			if k.layer == i && !done[k] {
+				rest = append(rest, k)
+			}
+		}
+		sort.Slice(rest, func(i, j int) bool {
+			if rest[i].x != rest[j].x {
+				return rest[i].x < rest[j].x
+			}
+			return rest[i].y < rest[j].y
+		})
+		for _, k := range rest {
+			layers[i] = append(layers[i], result[k]...)
+		}
+	}
+	merged.Player = layers[0]
+	merged.Tiles = layers[1]
+	merged.Objects = layers[2]
+	merged.Enemies = layers[3]
+	merged.Blocks = layers[4]
+	merged.Walls = layers[5]
+	merged.Switches = layers[6]
+
+	sort.SliceStable(conflicts, func(i, j int) bool {
+		ci, cj := conflicts[i], conflicts[j]
+		if (ci.Field == "") != (cj.Field == "") {
+			return ci.Field != ""
+		}
+		if ci.Y != cj.Y {
+			return ci.Y < cj.Y
+		}
+		if ci.X != cj.X {
+			return ci.X < cj.X
+		}
+		return layerIndex(ci.Layer) < layerIndex(cj.Layer)
+	})
+	return merged, conflicts
+}
+
+// Reports whether two tile stacks are the same, ignoring order.
+func sameStack(a, b []Tile) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	used := make([]bool, len(b))
+outer:
+	for _, x := range a {
+		for j, y := range b {
+			if !used[j] && sameTile(x, y) && sameExtra(x, y) {
+				used[j] = true
+				continue outer
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func sameExtra(a, b Tile) bool {
+	if len(a.Extra) != len(b.Extra) || len(a.Attributes.Extra) != len(b.Attributes.Extra) {
+		return false
+	}
+	for i := range a.Extra {
+		if a.Extra[i] != b.Extra[i] {
+			return false
+		}
+	}
+	for i := range a.Attributes.Extra {
+		if a.Attributes.Extra[i] != b.Attributes.Extra[i] {
+			return false
+		}
+	}
+	return true
+}
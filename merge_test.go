@@ -0,0 +1,104 @@
+package cc3d
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func mergeBase() *Map {
+	return &Map{
+		Name:    "Level",
+		Width:   3,
+		Height:  1,
+		Tiles:   []Tile{tile(0, 0, 1, 0), tile(1, 0, 1, 0), tile(2, 0, 1, 0)},
+		Objects: []Tile{tile(1, 0, 38, 0)},
+	}
+}
+
+func TestMergeSeparateChanges(t *testing.T) {
+	base := mergeBase()
+	ours := mergeBase()
+	ours.Name = "Our Level"
+	ours.Tiles[0] = tile(0, 0, 2, 0)
+	theirs := mergeBase()
+	theirs.Tiles[2] = tile(2, 0, 3, 0)
+	// a different layer of the same cell as ours
+	theirs.Objects = nil
+
+	m, conflicts := Merge(base, ours, theirs)
+	if len(conflicts) != 0 {
+		t.Fatalf("unexpected conflicts: %v", conflicts)
+	}
+	if m.Name != "Our Level" {
+		t.Errorf("Name = %q, want %q", m.Name, "Our Level")
+	}
+	want := []Tile{tile(0, 0, 2, 0), tile(1, 0, 1, 0), tile(2, 0, 3, 0)}
+	if !sameStack(m.Tiles, want) {
+		t.Errorf("Tiles = %v, want %v", m.Tiles, want)
+	}
+	if len(m.Objects) != 0 {
+		t.Errorf("Objects = %v, want none", m.Objects)
+	}
+}
+
+func TestMergeConflicts(t *testing.T) {
+	base := mergeBase()
+	ours := mergeBase()
+	ours.Width = 4
+	ours.Tiles[1] = tile(1, 0, 2, 0)
+	ours.Objects = nil
+	theirs := mergeBase()
+	theirs.Width = 5
+	theirs.Tiles[1] = tile(1, 0, 3, 0)
+	theirs.Objects = nil
+
+	m, conflicts := Merge(base, ours, theirs)
+	if len(conflicts) != 2 {
+		t.Fatalf("got %d conflicts, want 2: %v", len(conflicts), conflicts)
+	}
+	if c := conflicts[0]; c.Field != "width" || c.OursValue != "4" || c.TheirsValue != "5" {
+		t.Errorf("conflict 0 = %v, want width 4 vs 5", c)
+	}
+	c := conflicts[1]
+	if c.Field != "" || c.Layer != "tiles" || c.X != 1 || c.Y != 0 {
+		t.Errorf("conflict 1 = %v, want a conflict at (1,0) in tiles", c)
+	}
+	if !sameStack(c.Base, []Tile{tile(1, 0, 1, 0)}) || !sameStack(c.Ours, []Tile{tile(1, 0, 2, 0)}) || !sameStack(c.Theirs, []Tile{tile(1, 0, 3, 0)}) {
+		t.Errorf("conflict 1 has the wrong tiles: %v", c)
+	}
+
+	// Conflicts keep our side; both removing the key is not a conflict.
+	if m.Width != 4 {
+		t.Errorf("Width = %d, want ours (4)", m.Width)
+	}
+	if !sameStack(m.Tiles, ours.Tiles) {
+		t.Errorf("Tiles = %v, want ours %v", m.Tiles, ours.Tiles)
+	}
+	if len(m.Objects) != 0 {
+		t.Errorf("Objects = %v, want none", m.Objects)
+	}
+}
+
+func TestSameStack(t *testing.T) {
+	a, b := tile(0, 0, 1, 0), tile(0, 0, 10, 1)
+	extra := b
+	extra.Attributes.Extra = append(extra.Attributes.Extra, xml.Attr{Name: xml.Name{Local: "colour"}, Value: "red"})
+	tests := []struct {
+		x, y []Tile
+		want bool
+	}{
+		{nil, nil, true},
+		{nil, []Tile{a}, false},
+		{[]Tile{a, b}, []Tile{a, b}, true},
+		{[]Tile{a, b}, []Tile{b, a}, true},
+		{[]Tile{a, a}, []Tile{a, b}, false},
+		{[]Tile{a, b}, []Tile{a, tile(0, 0, 10, 2)}, false},
+		{[]Tile{a, b}, []Tile{a, extra}, false},
+		{[]Tile{extra}, []Tile{extra}, true},
+	}
+	for i, tt := range tests {
+		if got := sameStack(tt.x, tt.y); got != tt.want {
+			t.Errorf("%d: sameStack(%v, %v) = %v, want %v", i, tt.x, tt.y, got, tt.want)
+		}
+	}
+}
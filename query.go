@@ -0,0 +1,369 @@
+package cc3d
+
+// A small query language for searching levels.
+//
+// A query is a list of terms separated by spaces. A level matches if it
+// matches every term. A term can be negated by prefixing it with a '-'.
+// Values containing spaces can be quoted with double quotes.
+//
+//    author:VALUE      author contains VALUE (case insensitive)
+//    name:VALUE        level name contains VALUE (case insensitive)
+//    WORD              name or author contains WORD
+//    width>20          compare the width, height, or background
+//    has:PRED          at least one tile matches PRED
+//    count(PRED)>1     the number of tiles matching PRED
+//    layer:NAME        only consider tiles in the named layer (e.g. enemies)
+//
+// The comparison operators are =, !=, <, <=, >, and >=.
+//
+// A tile predicate (PRED) is one or more alternatives separated by '|',
+// each of which is a list of conditions separated by commas.
+// A condition is either type=N, dir=N, or flags=N, or a tile name like Snappy.
+// For example, has:type=191|type=192 matches Kickstarter and Developer Support blocks,
+// and count(type=22,dir=1)=1 matches levels with exactly one east-facing Woop.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A Query is a parsed search query.
+type Query struct {
+	terms  []term
+	layers []string // if non-empty, only tiles in these layers are considered
+}
+
+// A Match is a tile which satisfied a query.
+type Match struct {
+	Layer string
+	X, Y  int // tile coordinates, not pixels
+	Tile  Tile
+}
+
+type term struct {
+	negate bool
+
+	// exactly one of these is set
+	text  string // name or author substring
+	field string // author, name, width, height, background
+	pred  tilePred
+
+	count bool // count(pred) instead of has:pred
+	op    string
+	value string
+	num   int
+}
+
+// A tilePred is a disjunction of conjunctions.
+type tilePred [][]tileCond
+
+type tileCond struct {
+	attr  string // type, dir, flags, or name
+	num   uint64
+	value string
+}
+
+// ParseQuery parses a search query.
+func ParseQuery(s string) (*Query, error) {
+	words, err := splitQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	q := new(Query)
+	for _, w := range words {
+		if strings.HasPrefix(w, "layer:") {
+			name := strings.ToLower(strings.TrimPrefix(w, "layer:"))
+			if !IsLayerName(name) {
+				return nil, fmt.Errorf("query: unknown layer %q", name)
+			}
+			q.layers = append(q.layers, name)
+			continue
+		}
+		t, err := parseTerm(w)
+		if err != nil {
+			return nil, err
+		}
+		q.terms = append(q.terms, t)
+	}
+	return q, nil
+}
+
+// Split a query into words, respecting double quotes.
+// Quotes are removed from the returned words.
+func splitQuery(s string) ([]string, error) {
+	var words []string
+	var word []rune
+	inWord, inQuote := false, false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+			inWord = true
+		case unicode.IsSpace(r) && !inQuote:
+			if inWord {
+				words = append(words, string(word))
+				word = word[:0]
+				inWord = false
+			}
+		default:
+			word = append(word, r)
+			inWord = true
+		}
+	}
+	if inQuote {
+		return nil, fmt.Errorf("query: unterminated quote")
+	}
+	if inWord {
+		words = append(words, string(word))
+	}
+	return words, nil
+}
+
+var queryOps = []string{"!=", "<=", ">=", "=", "<", ">"} // longest first
+
+// Split s at the first comparison operator.
+func splitOp(s string) (before, op, after string, ok bool) {
+	for i := 0; i < len(s); i++ {
+		for _, op := range queryOps {
+			if strings.HasPrefix(s[i:], op) {
+				return s[:i], op, s[i+len(op):], true
+			}
+		}
+	}
+	return s, "", "", false
+}
+
+func parseTerm(w string) (term, error) {
+	var t term
+	if w == "" {
+		return t, fmt.Errorf("query: empty term")
+	}
+	if strings.HasPrefix(w, "-") && len(w) > 1 {
+		t.negate = true
+		w = w[1:]
+	}
+	if strings.HasPrefix(w, "count(") {
+		i := strings.LastIndex(w, ")")
+		if i < 0 {
+			return t, fmt.Errorf("query: missing ) in %q", w)
+		}
+		pred, err := parsePred(w[len("count("):i])
+		if err != nil {
+			return t, err
+		}
+		_, op, value, ok := splitOp(w[i+1:])
+		if !ok {
+			return t, fmt.Errorf("query: missing comparison after %q", w[:i+1])
+		}
+		t.pred = pred
+		t.count = true
+		t.op = op
+		t.num, err = strconv.Atoi(value)
+		if err != nil {
+			return t, fmt.Errorf("query: invalid count %q", value)
+		}
+		return t, nil
+	}
+	field, value, found := cutQuery(w, ":")
+	if found {
+		switch strings.ToLower(field) {
+		case "has":
+			pred, err := parsePred(value)
+			if err != nil {
+				return t, err
+			}
+			t.pred = pred
+			return t, nil
+		case "author", "name":
+			t.field = strings.ToLower(field)
+			t.op = "~"
+			t.value = strings.ToLower(value)
+			return t, nil
+		case "width", "height", "background":
+			// width:20 is the same as width=20
+			w = field + "=" + value
+		default:
+			return t, fmt.Errorf("query: unknown field %q", field)
+		}
+	}
+	if field, op, value, ok := splitOp(w); ok {
+		field = strings.ToLower(field)
+		switch field {
+		case "width", "height", "background":
+		default:
+			return t, fmt.Errorf("query: cannot compare %q", field)
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return t, fmt.Errorf("query: invalid number %q", value)
+		}
+		t.field = field
+		t.op = op
+		t.num = n
+		return t, nil
+	}
+	t.text = strings.ToLower(w)
+	return t, nil
+}
+
+func parsePred(s string) (tilePred, error) {
+	if s == "" {
+		return nil, fmt.Errorf("query: empty tile predicate")
+	}
+	var pred tilePred
+	for _, alt := range strings.Split(s, "|") {
+		var conds []tileCond
+		for _, c := range strings.Split(alt, ",") {
+			attr, value, found := cutQuery(c, "=")
+			attr = strings.ToLower(attr)
+			if !found {
+				conds = append(conds, tileCond{attr: "name", value: strings.ToLower(c)})
+				continue
+			}
+			switch attr {
+			case "type", "dir", "flags":
+				n, err := strconv.ParseUint(value, 0, 64)
+				if err != nil {
+					return nil, fmt.Errorf("query: invalid %s %q", attr, value)
+				}
+				conds = append(conds, tileCond{attr: attr, num: n})
+			case "name":
+				conds = append(conds, tileCond{attr: attr, value: strings.ToLower(value)})
+			default:
+				return nil, fmt.Errorf("query: unknown tile attribute %q", attr)
+			}
+		}
+		pred = append(pred, conds)
+	}
+	return pred, nil
+}
+
+func cutQuery(s, sep string) (before, after string, found bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+func (p tilePred) match(t Tile) bool {
+	for _, conds := range p {
+		ok := true
+		for _, c := range conds {
+			if !c.match(t) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c tileCond) match(t Tile) bool {
+	switch c.attr {
+	case "type":
+		return uint64(t.Type) == c.num
+	case "dir":
+		return uint64(t.Direction) == c.num
+	case "flags":
+		return t.Attributes.Flags == c.num
+	case "name":
+		return strings.ToLower(t.Attributes.Name) == c.value
+	}
+	return false
+}
+
+func compare(a int, op string, b int) bool {
+	switch op {
+	case "=":
+		return a == b
+	case "!=":
+		return a != b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	}
+	return false
+}
+
+// Match reports whether the level matches the query.
+// If it does, it also returns the tiles which satisfied has: and count() terms.
+func (q *Query) Match(m *Map) (matches []Match, ok bool) {
+	for _, t := range q.terms {
+		var found []Match
+		var ok bool
+		switch {
+		case t.text != "":
+			ok = strings.Contains(strings.ToLower(m.Name), t.text) ||
+				strings.Contains(strings.ToLower(m.Author), t.text)
+		case t.field == "author":
+			ok = strings.Contains(strings.ToLower(m.Author), t.value)
+		case t.field == "name":
+			ok = strings.Contains(strings.ToLower(m.Name), t.value)
+		case t.field == "width":
+			ok = compare(m.Width, t.op, t.num)
+		case t.field == "height":
+			ok = compare(m.Height, t.op, t.num)
+		case t.field == "background":
+			ok = compare(m.Background, t.op, t.num)
+		default:
+			found = q.findTiles(m, t.pred)
+			if t.count {
+				ok = compare(len(found), t.op, t.num)
+			} else {
+				ok = len(found) > 0
+			}
+		}
+		if ok == t.negate {
+			return nil, false
+		}
+		if !t.negate {
+			matches = append(matches, found...)
+		}
+	}
+	return matches, true
+}
+
+// NeedsTiles reports whether matching the query requires the level's tiles,
+// or whether the header (name, author, size, and background) is enough.
+func (q *Query) NeedsTiles() bool {
+	for _, t := range q.terms {
+		if t.text == "" && t.field == "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *Query) findTiles(m *Map, pred tilePred) []Match {
+	var found []Match
+	for _, l := range m.Layers() {
+		if len(q.layers) > 0 && !containsString(q.layers, l.Name) {
+			continue
+		}
+		for _, t := range l.Tiles {
+			if pred.match(t) {
+				found = append(found, Match{l.Name, t.X / 64, t.Y / 64, t})
+			}
+		}
+	}
+	return found
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package cc3d
+
+import "testing"
+
+func testQueryLevel() *Map {
+	return &Map{
+		Name:       "Outside Port",
+		Author:     "supernewton",
+		Width:      11,
+		Height:     12,
+		Background: 2,
+		Player: []Tile{
+			{X: 128, Y: 128, Type: 22, Direction: 1, Attributes: Attributes{Name: "Woop"}},
+		},
+		Tiles: []Tile{
+			{X: 0, Y: 0, Type: 2, Attributes: Attributes{Name: "Wall"}},
+			{X: 64, Y: 0, Type: 2, Attributes: Attributes{Name: "Wall"}},
+		},
+		Enemies: []Tile{
+			{X: 192, Y: 64, Type: 51, Direction: 2, Attributes: Attributes{Name: "Snappy", Flags: 0x10}},
+		},
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	for _, q := range []string{
+		`""`,
+		`name:"unterminated`,
+		`colour:red`,
+		`layer:ceiling`,
+		`width>wide`,
+		`name<3`,
+		`has:`,
+		`has:type=x`,
+		`has:size=3`,
+		`count(type=2`,
+		`count(type=2)`,
+		`count(type=2)>many`,
+	} {
+		if _, err := ParseQuery(q); err == nil {
+			t.Errorf("ParseQuery(%q) succeeded, want an error", q)
+		}
+	}
+}
+
+func TestQueryMatch(t *testing.T) {
+	m := testQueryLevel()
+	for _, tt := range []struct {
+		query   string
+		ok      bool
+		matches int
+	}{
+		{"", true, 0},
+		{"port", true, 0},
+		{"PORT newton", true, 0},
+		{"starboard", false, 0},
+		{"-starboard", true, 0},
+		{"-port", false, 0},
+		{`name:"outside port"`, true, 0},
+		{`author:"outside port"`, false, 0},
+		{"author:newton", true, 0},
+		{"width=11 height:12", true, 0},
+		{"width>11", false, 0},
+		{"width>=11 height!=11 background<3", true, 0},
+		{"has:snappy", true, 1},
+		{"has:type=2", true, 2},
+		{"has:type=2 has:snappy", true, 3},
+		{"has:type=51,dir=2", true, 1},
+		{"has:type=51,dir=1", false, 0},
+		{"has:type=99|name=woop", true, 1},
+		{"has:flags=0x10", true, 1},
+		{"-has:type=99", true, 0},
+		{"count(type=2)=2", true, 2},
+		{"count(type=2)>2", false, 0},
+		{"count(type=99)=0", true, 0},
+		{"layer:enemies has:type=2", false, 0},
+		{"layer:tiles has:type=2", true, 2},
+		{"layer:tiles layer:player has:type=22", true, 1},
+	} {
+		q, err := ParseQuery(tt.query)
+		if err != nil {
+			t.Errorf("ParseQuery(%q): %v", tt.query, err)
+			continue
+		}
+		matches, ok := q.Match(m)
+		if ok != tt.ok || len(matches) != tt.matches {
+			t.Errorf("%q: got ok=%v with %d matches, want ok=%v with %d", tt.query, ok, len(matches), tt.ok, tt.matches)
+		}
+	}
+}
+
+func TestQueryMatchPosition(t *testing.T) {
+	q, err := ParseQuery("has:snappy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches, ok := q.Match(testQueryLevel())
+	if !ok || len(matches) != 1 {
+		t.Fatalf("got %v, %v", matches, ok)
+	}
+	if m := matches[0]; m.Layer != "enemies" || m.X != 3 || m.Y != 1 {
+		t.Errorf("got a match in %s at (%d,%d), want enemies at (3,1)", m.Layer, m.X, m.Y)
+	}
+}
+
+func TestQueryNeedsTiles(t *testing.T) {
+	for _, tt := range []struct {
+		query string
+		want  bool
+	}{
+		{"port author:newton width>10", false},
+		{"-port", false},
+		{"has:snappy", true},
+		{"port count(type=2)>1", true},
+	} {
+		q, err := ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := q.NeedsTiles(); got != tt.want {
+			t.Errorf("NeedsTiles(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package cc3d
+
+// Streaming level reader
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Limits restricts the size of the levels a Reader will accept.
+// Zero values mean no limit. If MaxWidth or MaxHeight is set,
+// a width or height less than 1 is rejected as well.
+type Limits struct {
+	MaxWidth  int
+	MaxHeight int
+	MaxTiles  int   // total number of tiles in all layers
+	MaxBytes  int64 // size of the uncompressed XML
+}
+
+// DefaultLimits are generous limits suitable for untrusted input.
+// Real levels are much smaller than this.
+var DefaultLimits = Limits{
+	MaxWidth:  256,
+	MaxHeight: 256,
+	MaxTiles:  256 * 256 * 4,
+	MaxBytes:  64 << 20,
+}
+
+var (
+	ErrBadSize  = errors.New("level has an invalid size")
+	ErrTooLarge = errors.New("level is too large")
+	ErrTooMany  = errors.New("level has too many tiles")
+)
+
+// A ParseError describes a problem reading a level.
+type ParseError struct {
+	Line, Column int    // position of the error in the XML, or 0 if unknown
+	Element      string // name of the element being read, if any
+	Err          error
+}
+
+func (e *ParseError) Error() string {
+	s := ""
+	if e.Line > 0 {
+		s = fmt.Sprintf("line %d, column %d: ", e.Line, e.Column)
+	}
+	if e.Element != "" {
+		s += "<" + e.Element + ">: "
+	}
+	return s + e.Err.Error()
+}
+
+func (e *ParseError) Unwrap() error { return e.Err }
+
+// A Reader reads a level one layer at a time,
+// without holding the whole level in memory.
+type Reader struct {
+	d      *xml.Decoder
+	limits Limits
+	header Map
+	ntiles int
+	done   bool
+}
+
+// NewReader starts reading a level and parses the <map> element's attributes.
+// The level may be gzipped and in any of the encodings ReadLevel accepts.
+func NewReader(r io.Reader, limits Limits) (*Reader, error) {
+	r, err := decodeInput(r)
+	if err != nil {
+		return nil, &ParseError{Err: err}
+	}
+	if limits.MaxBytes > 0 {
+		r = &limitedReader{r, limits.MaxBytes, limits.MaxBytes}
+	}
+	lr := &Reader{
+		d:      xml.NewDecoder(r),
+		limits: limits,
+	}
+	lr.d.CharsetReader = charsetReader
+	for {
+		tok, err := lr.d.Token()
+		if err == io.EOF {
+			return nil, lr.errorf("", "missing <map> element")
+		}
+		if err != nil {
+			return nil, lr.error("", err)
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			if start.Name.Local != "map" {
+				return nil, lr.errorf(start.Name.Local, "not a level: expected <map> element")
+			}
+			if err := lr.readHeader(start); err != nil {
+				return nil, err
+			}
+			return lr, nil
+		}
+	}
+}
+
+func (lr *Reader) error(elem string, err error) error {
+	var pe *ParseError
+	if errors.As(err, &pe) {
+		return err
+	}
+	line, col := lr.d.InputPos()
+	return &ParseError{Line: line, Column: col, Element: elem, Err: err}
+}
+
+func (lr *Reader) errorf(elem string, format string, args ...interface{}) error {
+	return lr.error(elem, fmt.Errorf(format, args...))
+}
+
+func (lr *Reader) readHeader(start xml.StartElement) error {
+	m := &lr.header
+	for _, attr := range start.Attr {
+		var err error
+		switch attr.Name.Local {
+		case "author":
+			m.Author = attr.Value
+		case "name":
+			m.Name = attr.Value
+		case "width":
+			m.Width, err = strconv.Atoi(attr.Value)
+		case "height":
+			m.Height, err = strconv.Atoi(attr.Value)
+		case "background":
+			m.Background, err = strconv.Atoi(attr.Value)
+		}
+		if err != nil {
+			return lr.errorf(start.Name.Local, "invalid %s attribute: %q", attr.Name.Local, attr.Value)
+		}
+	}
+	if lr.limits.MaxWidth > 0 && m.Width <= 0 ||
+		lr.limits.MaxHeight > 0 && m.Height <= 0 {
+		return lr.error(start.Name.Local, fmt.Errorf("%w: %dx%d", ErrBadSize, m.Width, m.Height))
+	}
+	if lr.limits.MaxWidth > 0 && m.Width > lr.limits.MaxWidth ||
+		lr.limits.MaxHeight > 0 && m.Height > lr.limits.MaxHeight {
+		return lr.error(start.Name.Local, fmt.Errorf("%w: %dx%d", ErrTooLarge, m.Width, m.Height))
+	}
+	return nil
+}
+
+// Header returns the level with only the <map> attributes filled in.
+func (lr *Reader) Header() *Map {
+	m := lr.header
+	return &m
+}
+
+// NextLayer reads the next layer of tiles.
+// Unknown elements are skipped and added to the header's ExtraElem.
+// Returns io.EOF after the last layer.
+func (lr *Reader) NextLayer() (Layer, error) {
+	if lr.done {
+		return Layer{}, io.EOF
+	}
+	for {
+		tok, err := lr.d.Token()
+		if err == io.EOF {
+			return Layer{}, lr.errorf("map", "unexpected end of file")
+		}
+		if err != nil {
+			return Layer{}, lr.error("map", err)
+		}
+		switch tok := tok.(type) {
+		case xml.EndElement:
+			// end of <map>
+			lr.done = true
+			return Layer{}, io.EOF
+		case xml.StartElement:
+			if !IsLayerName(tok.Name.Local) {
+				lr.header.ExtraElem = append(lr.header.ExtraElem, tok.Name)
+				if err := lr.d.Skip(); err != nil {
+					return Layer{}, lr.error(tok.Name.Local, err)
+				}
+				continue
+			}
+			tiles, err := lr.readTiles(tok.Name.Local)
+			return Layer{tok.Name.Local, tiles}, err
+		}
+	}
+}
+
+func (lr *Reader) readTiles(layer string) ([]Tile, error) {
+	var tiles []Tile
+	for {
+		tok, err := lr.d.Token()
+		if err == io.EOF {
+			return nil, lr.errorf(layer, "unexpected end of file")
+		}
+		if err != nil {
+			return nil, lr.error(layer, err)
+		}
+		switch tok := tok.(type) {
+		case xml.EndElement:
+			return tiles, nil
+		case xml.StartElement:
+			if tok.Name.Local != "tile" {
+				if err := lr.d.Skip(); err != nil {
+					return nil, lr.error(tok.Name.Local, err)
+				}
+				continue
+			}
+			if lr.limits.MaxTiles > 0 && lr.ntiles >= lr.limits.MaxTiles {
+				return nil, lr.error("tile", fmt.Errorf("%w: more than %d", ErrTooMany, lr.limits.MaxTiles))
+			}
+			var t Tile
+			if err := lr.d.DecodeElement(&t, &tok); err != nil {
+				return nil, lr.error("tile", err)
+			}
+			lr.ntiles++
+			tiles = append(tiles, t)
+		}
+	}
+}
+
+// ReadAll reads the remaining layers and returns the whole level.
+func (lr *Reader) ReadAll() (*Map, error) {
+	layers := make([][]Tile, len(LayerNames))
+	for {
+		l, err := lr.NextLayer()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		i := layerIndex(l.Name)
+		layers[i] = append(layers[i], l.Tiles...)
+	}
+	m := lr.Header()
+	m.Player = layers[0]
+	m.Tiles = layers[1]
+	m.Objects = layers[2]
+	m.Enemies = layers[3]
+	m.Blocks = layers[4]
+	m.Walls = layers[5]
+	m.Switches = layers[6]
+	return m, nil
+}
+
+// ReadHeader reads just the <map> attributes of a level: name, author, size and background.
+func ReadHeader(r io.Reader) (*Map, error) {
+	lr, err := NewReader(r, Limits{})
+	if err != nil {
+		return nil, err
+	}
+	return lr.Header(), nil
+}
+
+// ReadLevelLimits is like ReadLevel but rejects levels which exceed the given limits.
+func ReadLevelLimits(r io.Reader, limits Limits) (*Map, error) {
+	lr, err := NewReader(r, limits)
+	if err != nil {
+		return nil, err
+	}
+	return lr.ReadAll()
+}
+
+// limitedReader is like io.LimitedReader, but returns an error
+// instead of EOF when the limit is exceeded.
+type limitedReader struct {
+	r   io.Reader
+	n   int64 // bytes remaining
+	max int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, fmt.Errorf("%w: more than %d bytes", ErrTooLarge, l.max)
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
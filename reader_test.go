@@ -0,0 +1,98 @@
+package cc3d
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func limitsLevel(width, height, ntiles int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<map name=\"Limits\" width=\"%d\" height=\"%d\">\n<tiles>\n", width, height)
+	for i := 0; i < ntiles; i++ {
+		fmt.Fprintf(&b, "<tile x=\"%d\" y=\"0\" type=\"1\"/>\n", i*64)
+	}
+	b.WriteString("</tiles>\n</map>\n")
+	return b.String()
+}
+
+func TestReaderLimits(t *testing.T) {
+	limits := Limits{MaxWidth: 10, MaxHeight: 8, MaxTiles: 5, MaxBytes: 1000}
+	tests := []struct {
+		desc  string
+		input string
+		err   error
+	}{
+		{"ok", limitsLevel(10, 8, 5), nil},
+		{"too wide", limitsLevel(11, 8, 1), ErrTooLarge},
+		{"too tall", limitsLevel(10, 9, 1), ErrTooLarge},
+		{"zero width", limitsLevel(0, 8, 1), ErrBadSize},
+		{"negative height", limitsLevel(10, -1, 1), ErrBadSize},
+		{"too many tiles", limitsLevel(10, 8, 6), ErrTooMany},
+		{"too many bytes", strings.Replace(limitsLevel(10, 8, 5), "<tiles>", "<tiles>"+strings.Repeat(" ", 1000), 1), ErrTooLarge},
+	}
+	for _, tt := range tests {
+		_, err := ReadLevelLimits(strings.NewReader(tt.input), limits)
+		if tt.err == nil {
+			if err != nil {
+				t.Errorf("%s: %v", tt.desc, err)
+			}
+			continue
+		}
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: got error %v, want %v", tt.desc, err, tt.err)
+		}
+		var pe *ParseError
+		if !errors.As(err, &pe) {
+			t.Errorf("%s: error %v is not a *ParseError", tt.desc, err)
+		}
+	}
+
+	// no limits
+	if _, err := ReadLevel(strings.NewReader(limitsLevel(1000, 0, 100))); err != nil {
+		t.Errorf("ReadLevel: %v", err)
+	}
+}
+
+func TestParseErrorPosition(t *testing.T) {
+	tests := []struct {
+		desc      string
+		input     string
+		line, col int
+		elem      string
+	}{
+		{"bad attribute", "<map>\n<tiles>\n  <tile x=\"0\" y=\"a\"/>\n</tiles>\n</map>\n", 3, 22, "tile"},
+		{"unclosed layer", "<map>\n<tiles>\n<tile/>\n</map>\n", 4, 7, "tiles"},
+		{"bad width", "\n\n<map width=\"wide\">\n</map>\n", 3, 19, "map"},
+	}
+	for _, tt := range tests {
+		_, err := ReadLevel(strings.NewReader(tt.input))
+		var pe *ParseError
+		if !errors.As(err, &pe) {
+			t.Errorf("%s: got error %v, want a *ParseError", tt.desc, err)
+			continue
+		}
+		if pe.Line != tt.line || pe.Column != tt.col || pe.Element != tt.elem {
+			t.Errorf("%s: got error at line %d, column %d in <%s>; want line %d, column %d in <%s>",
+				tt.desc, pe.Line, pe.Column, pe.Element, tt.line, tt.col, tt.elem)
+		}
+		if want := fmt.Sprintf("line %d, column %d: <%s>: ", tt.line, tt.col, tt.elem); !strings.HasPrefix(pe.Error(), want) {
+			t.Errorf("%s: Error() = %q, want prefix %q", tt.desc, pe.Error(), want)
+		}
+	}
+}
+
+func TestReaderRootElement(t *testing.T) {
+	_, err := ReadLevel(strings.NewReader(`<?xml version="1.0"?><svg width="10" height="10"></svg>`))
+	var pe *ParseError
+	if !errors.As(err, &pe) || pe.Element != "svg" {
+		t.Errorf("got error %v, want a *ParseError for <svg>", err)
+	}
+
+	_, err = ReadLevel(strings.NewReader(""))
+	if err == nil || errors.Is(err, io.EOF) {
+		t.Errorf("empty input: got error %v, want a missing <map> error", err)
+	}
+}
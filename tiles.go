@@ -0,0 +1,144 @@
+package cc3d
+
+import "sort"
+
+// Names of the known tile types, as they appear in the editor.
+// Levels store a name for every tile as well, but it isn't always the same.
+var tileNames = map[int]string{
+	1:   "Floor Tile",                    // 01
+	2:   "Wall",                          // 02
+	3:   "Ice",                           // 03
+	4:   "Ice Corner",                    // 04
+	5:   "Ice Corner",                    // 05
+	6:   "Ice Corner",                    // 06
+	7:   "Ice Corner",                    // 07
+	8:   "Water",                         // 08
+	9:   "Fire",                          // 09
+	10:  "Force floor",                   // 0a
+	11:  "Force floor",                   // 0b
+	12:  "Force floor",                   // 0c
+	13:  "Force floor",                   // 0d
+	14:  "Closed toggle door",            // 0e
+	15:  "Open toggle door",              // 0f
+	16:  "Red teleport",                  // 10
+	17:  "Blue teleport",                 // 11
+	20:  "Exit",                          // 14
+	21:  "Slime",                         // 15
+	22:  "Woop",                          // 16
+	23:  "Dirt block",                    // 17
+	24:  "Walker",                        // 18
+	25:  "Blinky",                        // 19
+	26:  "Ice block",                     // 1a
+	30:  "Gravel",                        // 1e
+	31:  "Toggle door control",           // 1f
+	32:  "Blue Golem control",            // 20
+	33:  "Blue Golem",                    // 21
+	34:  "Red door",                      // 22
+	35:  "Blue door",                     // 23
+	36:  "Yellow door",                   // 24
+	37:  "Green door",                    // 25
+	38:  "Red key",                       // 26
+	39:  "Blue key",                      // 27
+	40:  "Yellow key",                    // 28
+	41:  "Green key",                     // 29
+	42:  "F.I.S.H.",                      // 2a
+	43:  "EXTRA F.I.S.H.",                // 2b
+	44:  "F.I.S.H. Door",                 // 2c
+	45:  "Push up wall",                  // 2d
+	46:  "Appearing wall",                // 2e
+	49:  "False blue wall",               // 31
+	50:  "Dirt",                          // 32
+	51:  "Limpa",                         // 33
+	52:  "Limpy",                         // 34
+	53:  "Bouncer",                       // 35
+	54:  "Omni",                          // 36
+	55:  "Snappy",                        // 37
+	56:  "Screamer",                      // 38
+	57:  "Clone machine switch",          // 39
+	59:  "Ice orb",                       // 3b
+	60:  "Force Field orb",               // 3c
+	61:  "Fire orb",                      // 3d
+	62:  "Water orb",                     // 3e
+	63:  "Security Gate Tools",           // 3f
+	64:  "Red bomb",                      // 40
+	65:  "Trap",                          // 41
+	66:  "Trap Control",                  // 42
+	68:  "Clone machine",                 // 44
+	70:  "Force floor random",            // 46
+	72:  "Regular Security Bot",          // 48
+	73:  "Rotating Security Bot",         // 49
+	74:  "Multidirectional Security Bot", // 4a
+	75:  "Laser Controller",              // 4b
+	76:  "Laser Shooter",                 // 4c
+	87:  "Nibble",                        // 57
+	99:  "Yellow Golem",                  // 63
+	100: "Yellow Golem control",          // 64
+	138: "Security Gate Keys",            // 8a
+	141: "TURTLE",                        // 8d
+	144: "Speed orb",                     // 90
+	147: "Panel Up",                      // 93
+	148: "Panel Right",                   // 94
+	149: "Panel Down",                    // 95
+	150: "Panel Left",                    // 96
+	154: "Blue Push Control",             // 9a
+	155: "Green Push Control",            // 9b
+	156: "Red Push Control",              // 9c
+	157: "Yellow Push Control",           // 9d
+	158: "Toggle Blue Control",           // 9e
+	159: "Toggle Red Control",            // 9f
+	160: "Toggle Yellow Control",         // a0
+	161: "Blue Block",                    // a1
+	162: "Green Block",                   // a2
+	163: "Red Block",                     // a3
+	164: "Yellow Block",                  // a4
+	165: "Toggle Blue Door Closed",       // a5
+	166: "Toggle Red Door Closed",        // a6
+	167: "Toggle Yellow Door Closed",     // a7
+	168: "Toggle Blue Door Open",         // a8
+	169: "Toggle Red Door Open",          // a9
+	170: "Toggle Yellow Door Open",       // aa
+	175: "Push Green Door Closed",        // af
+	176: "Push Blue Door Closed",         // b0
+	177: "Push Red Door Closed",          // b1
+	178: "Push Yellow Door Closed",       // b2
+	184: "Reflector LU",                  // b8
+	185: "Reflector DL",                  // b9
+	186: "Reflector UR",                  // ba
+	187: "Reflector RD",                  // bb
+	190: "RotatingCC Security Bot",       // be
+	191: "Kickstarter BLock",             // bf
+	192: "Developer Support BLock",       // c0
+	193: "Ben 10 Slime",                  // c1
+	194: "Baby Blinky",                   // c2
+	195: "Baby Screamer",                 // c3
+	196: "Legs Green",                    // c4
+	197: "Legs Red",                      // c5
+	198: "Sand",                          // c6
+	199: "Red F.I.S.H. Door",             // c7
+}
+
+// TileName returns the name of a tile type,
+// or the empty string if the type is unknown.
+func TileName(typ int) string {
+	return tileNames[typ]
+}
+
+// HasDirection reports whether tiles of the given type use their direction,
+// like force floors and monsters.
+func HasDirection(typ int) bool {
+	switch typ {
+	case 22, 24, 25, 33, 51, 52, 53, 54, 55, 56, 68, 72, 73, 74, 75, 76, 87, 99, 147, 148, 149, 150, 190, 194, 195, 196, 197:
+		return true
+	}
+	return false
+}
+
+// TileTypes returns all the known tile types in ascending order.
+func TileTypes() []int {
+	types := make([]int, 0, len(tileNames))
+	for typ := range tileNames {
+		types = append(types, typ)
+	}
+	sort.Ints(types)
+	return types
+}
@@ -0,0 +1,221 @@
+package main
+
+// Animated playback of a solution
+//
+// There is no game engine here, so this is only a rough preview:
+// the player walks one cell per move and is stopped by walls, closed doors,
+// and the edge of the map. Nothing else in the level moves or reacts.
+//
+// Moves are written as a string of U, D, L and R (case insensitive),
+// relative to the unflipped map. A '.' waits a turn, and whitespace is ignored.
+//
+// The output is an animated GIF. APNG would keep the full colour of the tiles,
+// but image/png can't write it.
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+	"log"
+	"os"
+
+	"github.com/magical/cc3d"
+)
+
+var delayFlag = flag.Int("delay", 15, "delay between frames for -animate, in 100ths of a second")
+
+// Longest move list we're willing to animate
+const maxMoves = 500
+
+// Largest animation the server will draw, in pixels per frame
+const maxAnimationArea = 2048 * 2048
+
+// Tile types which stop the player.
+// Doors are treated as always closed since we don't track keys.
+var solidTypes = map[int]bool{
+	2:   true, // Wall
+	14:  true, // Closed toggle door
+	34:  true, // Red door
+	35:  true, // Blue door
+	36:  true, // Yellow door
+	37:  true, // Green door
+	44:  true, // F.I.S.H. Door
+	45:  true, // Push up wall
+	68:  true, // Clone machine
+	165: true, // Toggle Blue Door Closed
+	166: true, // Toggle Red Door Closed
+	167: true, // Toggle Yellow Door Closed
+	175: true, // Push Green Door Closed
+	176: true, // Push Blue Door Closed
+	177: true, // Push Red Door Closed
+	178: true, // Push Yellow Door Closed
+	199: true, // Red F.I.S.H. Door
+}
+
+func animateMain(moves string) {
+	filename := flag.Arg(0)
+	if flag.NArg() == 0 {
+		filename = "-"
+	}
+	if flag.NArg() > 1 {
+		log.Fatal("too many arguments")
+	}
+	if outputFlag == "" {
+		log.Fatal("missing -o option")
+	}
+	var m *cc3d.Map
+	var err error
+	if filename == "-" {
+		m, err = cc3d.ReadLevel(os.Stdin)
+	} else {
+		m, err = readLevelFile(filename)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	out, err := os.Create(outputFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer out.Close()
+	if err := checkTileSize(*sizeFlag); err != nil {
+		log.Fatal(err)
+	}
+	if err := writeAnimation(out, m, loadTiles(loadSize(*sizeFlag)), *sizeFlag, moves, *delayFlag); err != nil {
+		log.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Parse a move list into a list of directions.
+// Waits are returned as -1.
+func parseMoves(s string) ([]int, error) {
+	var moves []int
+	for _, r := range s {
+		switch r {
+		case 'U', 'u':
+			moves = append(moves, 0)
+		case 'R', 'r':
+			moves = append(moves, 1)
+		case 'D', 'd':
+			moves = append(moves, 2)
+		case 'L', 'l':
+			moves = append(moves, 3)
+		case '.':
+			moves = append(moves, -1)
+		case ' ', '\t', '\n', '\r':
+		default:
+			return nil, fmt.Errorf("invalid move %q", r)
+		}
+	}
+	if len(moves) > maxMoves {
+		return nil, fmt.Errorf("too many moves: %d > %d", len(moves), maxMoves)
+	}
+	return moves, nil
+}
+
+// Write an animated GIF of the player following a move list.
+// The first frame shows the whole level;
+// later frames only redraw the cells that changed.
+// Frames are drawn with the tileset and scaled up to size like makeMap does.
+func writeAnimation(w io.Writer, m *cc3d.Map, tileset Tileset, size int, moves string, delay int) error {
+	dirs, err := parseMoves(moves)
+	if err != nil {
+		return err
+	}
+	solid := make(map[image.Point]bool)
+	for _, tiles := range [][]cc3d.Tile{m.Tiles, m.Walls, m.Blocks} {
+		for _, t := range tiles {
+			if solidTypes[t.Type] {
+				solid[image.Pt(t.X/64, t.Y/64)] = true
+			}
+		}
+	}
+
+	// Draw the level without the player once.
+	// Each frame restores the cells the player left from it
+	// and draws the player on top, the same way makeMap would.
+	level := *m
+	level.Player = nil
+	base, err := makeMap(&level, tileset, mapOptions{})
+	if err != nil {
+		return err
+	}
+	covered := make(map[image.Point]bool) // cells with something other than floor under the player
+	for _, l := range level.Layers() {
+		for _, t := range l.Tiles {
+			if t.Type != 1 {
+				covered[image.Pt(t.X/64, t.Y/64)] = true
+			}
+		}
+	}
+	canvas := image.NewRGBA(base.Bounds())
+	copy(canvas.Pix, base.Pix)
+	ts := tileset.TileSize()
+	cellRect := func(t cc3d.Tile) image.Rectangle {
+		x, y := t.X/64*ts, t.Y/64*ts
+		return image.Rect(x, y, x+ts, y+ts)
+	}
+	// Work on a copy of the player layer so we don't modify the caller's map
+	players := append([]cc3d.Tile(nil), m.Player...)
+	drawPlayers := func(r image.Rectangle) {
+		for _, p := range players {
+			if cr := cellRect(p); cr.Overlaps(r) {
+				drawTile(canvas, cr, p, tileset, covered[image.Pt(p.X/64, p.Y/64)])
+			}
+		}
+	}
+
+	anim := &gif.GIF{}
+	scale := 1
+	if size > ts && size%ts == 0 {
+		scale = size / ts
+	}
+	addFrame := func(r image.Rectangle, d int) {
+		fr := image.Rect(r.Min.X*scale, r.Min.Y*scale, r.Max.X*scale, r.Max.Y*scale)
+		frame := image.NewPaletted(fr, palette.Plan9)
+		src := scaleUp(canvas.SubImage(r).(*image.RGBA), ts, ts*scale)
+		draw.Draw(frame, fr, src, src.Bounds().Min, draw.Src)
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, d)
+		anim.Disposal = append(anim.Disposal, gif.DisposalNone)
+	}
+
+	drawPlayers(canvas.Bounds())
+	addFrame(canvas.Bounds(), delay)
+	for _, dir := range dirs {
+		var dirty image.Rectangle
+		for i := range players {
+			p := &players[i]
+			dirty = dirty.Union(cellRect(*p))
+			if dir < 0 {
+				continue
+			}
+			p.Direction = dir
+			d := [4]image.Point{{0, -1}, {1, 0}, {0, 1}, {-1, 0}}[dir]
+			next := image.Pt(p.X/64, p.Y/64).Add(d)
+			if next.X < 0 || next.X >= m.Width || next.Y < 0 || next.Y >= m.Height || solid[next] {
+				continue
+			}
+			p.X, p.Y = next.X*64, next.Y*64
+			dirty = dirty.Union(cellRect(*p))
+		}
+		if dirty.Empty() {
+			// no player; just wait
+			anim.Delay[len(anim.Delay)-1] += delay
+			continue
+		}
+		draw.Draw(canvas, dirty, base, dirty.Min, draw.Src)
+		drawPlayers(dirty)
+		addFrame(dirty, delay)
+	}
+	// Linger on the last frame
+	anim.Delay[len(anim.Delay)-1] += 100
+	return gif.EncodeAll(w, anim)
+}
@@ -0,0 +1,385 @@
+package main
+
+// Map rendering options and overlays
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/magical/cc3d"
+)
+
+var (
+	layersFlag      = flag.String("layers", "", "comma-separated list of layers to draw for -map (default all)")
+	unexpectedFlag  = flag.Bool("unexpected", false, "highlight tiles in unexpected layers")
+	gridFlag        = flag.Bool("grid", false, "draw grid lines and coordinates")
+	connectionsFlag = flag.Bool("connections", false, "draw clone machine, trap, and teleport connections")
+	diagnosticsFlag = flag.Bool("diagnostics", false, "mark problems found by the level checker")
+)
+
+// Options for makeMap.
+// The zero value draws every layer with no overlays.
+type mapOptions struct {
+	Size        int             // tile size in pixels; 0 means the tileset's size
+	Flip        bool            // rotate the map to match the game
+	Layers      map[string]bool // layers to draw; nil means all of them
+	Unexpected  bool            // highlight tiles in unexpected layers
+	Grid        bool            // draw grid lines and coordinates
+	Connections bool            // draw lines between connected tiles
+	Diagnostics bool            // mark the problems reported by cc3d.Diagnose
+}
+
+func mapOptionsFromFlags() (mapOptions, error) {
+	if err := checkTileSize(*sizeFlag); err != nil {
+		return mapOptions{}, err
+	}
+	layers, err := parseLayers(*layersFlag)
+	return mapOptions{
+		Size:        *sizeFlag,
+		Flip:        *flipFlag,
+		Layers:      layers,
+		Unexpected:  *unexpectedFlag,
+		Grid:        *gridFlag,
+		Connections: *connectionsFlag,
+		Diagnostics: *diagnosticsFlag,
+	}, err
+}
+
+// Parse map options from query parameters:
+// size, flip, layers, unexpected, grid, connections, and diagnostics.
+func mapOptionsFromQuery(q url.Values) (mapOptions, error) {
+	var opts mapOptions
+	var err error
+	if opts.Size, err = sizeFromQuery(q); err != nil {
+		return opts, err
+	}
+	if opts.Layers, err = parseLayers(q.Get("layers")); err != nil {
+		return opts, err
+	}
+	for _, b := range []struct {
+		name string
+		p    *bool
+	}{
+		{"flip", &opts.Flip},
+		{"unexpected", &opts.Unexpected},
+		{"grid", &opts.Grid},
+		{"connections", &opts.Connections},
+		{"diagnostics", &opts.Diagnostics},
+	} {
+		if v := q.Get(b.name); v != "" {
+			*b.p, err = strconv.ParseBool(v)
+			if err != nil {
+				return opts, fmt.Errorf("invalid %s parameter: %q", b.name, v)
+			}
+		}
+	}
+	return opts, nil
+}
+
+// Parse the size query parameter, which defaults to defaultTileSize.
+// Only the sizes in serverTileSizes are accepted.
+func sizeFromQuery(q url.Values) (int, error) {
+	v := q.Get("size")
+	if v == "" {
+		return defaultTileSize, nil
+	}
+	size, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size parameter: %q", v)
+	}
+	for _, s := range serverTileSizes {
+		if size == s {
+			return size, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported tile size %d; must be one of %v", size, serverTileSizes)
+}
+
+// Parse a comma-separated list of layer names into a set.
+func parseLayers(s string) (map[string]bool, error) {
+	if s == "" {
+		return nil, nil
+	}
+	layers := make(map[string]bool)
+	for _, name := range strings.Split(s, ",") {
+		if !cc3d.IsLayerName(name) {
+			return nil, fmt.Errorf("unknown layer %q", name)
+		}
+		layers[name] = true
+	}
+	return layers, nil
+}
+
+func (opts mapOptions) showLayer(name string) bool {
+	return opts.Layers == nil || opts.Layers[name]
+}
+
+// Returns the size of the map drawn with tiles of the given size.
+func (opts mapOptions) bounds(m *cc3d.Map, size int) image.Rectangle {
+	dx, dy := m.Width*size, m.Height*size
+	if opts.Flip {
+		dx, dy = dy, dx
+	}
+	return image.Rect(0, 0, dx, dy)
+}
+
+// Returns the rectangle covered by the cell at x,y (in tile coordinates).
+func (opts mapOptions) cellRect(m *cc3d.Map, size, x, y int) image.Rectangle {
+	px, py := x*size, y*size
+	if opts.Flip {
+		px = y * size
+		py = (m.Width - x - 1) * size
+	}
+	return image.Rect(px, py, px+size, py+size)
+}
+
+// The layers each tile type is normally found in.
+// Types which aren't listed can be anywhere.
+var expectedLayers = map[string][]int{
+	"player": {22},
+	"objects": {
+		38, 39, 40, 41, // keys
+		42, 43, // F.I.S.H.
+		59, 60, 61, 62, 144, // orbs
+		64, // Red bomb
+	},
+	"enemies": {
+		24, 25, 33, 51, 52, 53, 54, 55, 56, 87, 99,
+		72, 73, 74, 190, // security bots
+		194, 195, 196, 197,
+	},
+	"blocks": {
+		23, 26, // Dirt block, Ice block
+		161, 162, 163, 164, // coloured blocks
+		184, 185, 186, 187, // reflectors
+		191, 192,
+		147, 148, 149, 150, // panels
+	},
+	"walls": {
+		2, 45, 46, 49, 68,
+		14, 15, 34, 35, 36, 37, 44, 199, // doors
+		165, 166, 167, 168, 169, 170, 175, 176, 177, 178,
+		147, 148, 149, 150, // panels
+	},
+	"switches": {
+		31, 32, 57, 66, 100,
+		154, 155, 156, 157, 158, 159, 160,
+	},
+	"tiles": {
+		1, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 16, 17, 20, 21,
+		30, 50, 63, 65, 70, 75, 76, 138, 141, 193, 198,
+		// Walls, doors and coloured blocks turn up here too
+		2, 14, 15, 34, 35, 36, 37, 44, 199,
+		161, 162, 163, 164,
+	},
+}
+
+// Reports whether a tile is in a layer it isn't normally found in.
+func isUnexpected(layer string, typ int) bool {
+	known := false
+	for l, types := range expectedLayers {
+		for _, t := range types {
+			if t == typ {
+				if l == layer {
+					return false
+				}
+				known = true
+			}
+		}
+	}
+	return known
+}
+
+var (
+	gridColor       = color.NRGBA{0, 0, 0, 0x60}
+	unexpectedColor = color.NRGBA{0xff, 0, 0xff, 0x60}
+	diagnosticColor = color.NRGBA{0xff, 0, 0, 0x80}
+	cloneColor      = color.NRGBA{0xe0, 0x20, 0x20, 0xff}
+	trapColor       = color.NRGBA{0x90, 0x60, 0x20, 0xff}
+	redTeleColor    = color.NRGBA{0xff, 0x60, 0x60, 0xff}
+	blueTeleColor   = color.NRGBA{0x40, 0x80, 0xff, 0xff}
+)
+
+// Draw the overlays requested by opts on top of a map drawn with tiles of the given size.
+func drawAnnotations(im draw.Image, m *cc3d.Map, size int, opts mapOptions) {
+	if opts.Unexpected {
+		for _, l := range m.Layers() {
+			if !opts.showLayer(l.Name) {
+				continue
+			}
+			for _, t := range l.Tiles {
+				if isUnexpected(l.Name, t.Type) {
+					r := opts.cellRect(m, size, t.X/64, t.Y/64)
+					draw.Draw(im, r, image.NewUniform(unexpectedColor), image.ZP, draw.Over)
+					drawBorder(im, r, unexpectedColor)
+				}
+			}
+		}
+	}
+	if opts.Grid {
+		drawGrid(im, m, size, opts)
+	}
+	if opts.Connections {
+		drawConnections(im, m, size, opts)
+	}
+	if opts.Diagnostics {
+		bounds := im.Bounds()
+		for _, d := range cc3d.Diagnose(m) {
+			if d.Layer == "" {
+				continue
+			}
+			// Clamp out-of-range tiles to the edge of the map so they're still visible
+			r := opts.cellRect(m, size, clamp(d.X, 0, m.Width-1), clamp(d.Y, 0, m.Height-1))
+			if !r.In(bounds) {
+				continue
+			}
+			draw.Draw(im, r, image.NewUniform(diagnosticColor), image.ZP, draw.Over)
+			drawBorder(im, r, diagnosticColor)
+			p := r.Min.Add(image.Pt(size/2-glyphWidth*2/2, size/2-glyphHeight*2/2))
+			drawOutlinedText(im, p, "!", 2, color.White, color.Black)
+		}
+	}
+}
+
+func clamp(x, lo, hi int) int {
+	if x < lo {
+		return lo
+	}
+	if x > hi {
+		return hi
+	}
+	return x
+}
+
+// Draw lines between cells, and label each cell with its (unflipped) coordinates
+// if there's room.
+func drawGrid(im draw.Image, m *cc3d.Map, size int, opts mapOptions) {
+	src := image.NewUniform(gridColor)
+	b := im.Bounds()
+	for x := b.Min.X; x < b.Max.X; x += size {
+		draw.Draw(im, image.Rect(x, b.Min.Y, x+1, b.Max.Y), src, image.ZP, draw.Over)
+	}
+	for y := b.Min.Y; y < b.Max.Y; y += size {
+		draw.Draw(im, image.Rect(b.Min.X, y, b.Max.X, y+1), src, image.ZP, draw.Over)
+	}
+	if size < textSize("00,00", 1).X+4 {
+		return
+	}
+	for x := 0; x < m.Width; x++ {
+		for y := 0; y < m.Height; y++ {
+			r := opts.cellRect(m, size, x, y)
+			drawOutlinedText(im, r.Min.Add(image.Pt(3, 3)), fmt.Sprintf("%d,%d", x, y), 1, color.White, color.Black)
+		}
+	}
+}
+
+// Draw lines from buttons to the machines they control
+// and from teleports to their destinations.
+//
+// CC3D levels don't store connections, so this shows how the level
+// will be wired once it's converted to C2M: buttons connect to the next
+// machine in reading order, and teleports to the previous teleport of
+// the same colour, wrapping around at the ends.
+func drawConnections(im draw.Image, m *cc3d.Map, size int, opts mapOptions) {
+	var all []cc3d.Tile
+	for _, l := range m.Layers() {
+		all = append(all, l.Tiles...)
+	}
+	ofType := func(types ...int) []image.Point {
+		var ps []image.Point
+		for _, t := range all {
+			for _, typ := range types {
+				if t.Type == typ {
+					ps = append(ps, image.Pt(t.X/64, t.Y/64))
+				}
+			}
+		}
+		// Reading order of the converted level, which is rotated 90 degrees
+		sort.Slice(ps, func(i, j int) bool {
+			if ps[i].X != ps[j].X {
+				return ps[i].X > ps[j].X
+			}
+			return ps[i].Y < ps[j].Y
+		})
+		return ps
+	}
+	connect := func(from, to []image.Point, c color.NRGBA) {
+		for _, p := range from {
+			if q, ok := nextInReadingOrder(to, p); ok {
+				drawConnection(im, opts.cellRect(m, size, p.X, p.Y), opts.cellRect(m, size, q.X, q.Y), c)
+			}
+		}
+	}
+	connect(ofType(57), ofType(68), cloneColor)
+	connect(ofType(66), ofType(65), trapColor)
+	for _, tele := range []struct {
+		typ int
+		c   color.NRGBA
+	}{{16, redTeleColor}, {17, blueTeleColor}} {
+		ps := ofType(tele.typ)
+		if len(ps) < 2 {
+			continue
+		}
+		for i, p := range ps {
+			q := ps[(i+len(ps)-1)%len(ps)]
+			drawConnection(im, opts.cellRect(m, size, p.X, p.Y), opts.cellRect(m, size, q.X, q.Y), tele.c)
+		}
+	}
+}
+
+// Returns the first point in ps (which must be in reading order) after p,
+// wrapping around to the start.
+func nextInReadingOrder(ps []image.Point, p image.Point) (image.Point, bool) {
+	if len(ps) == 0 {
+		return image.Point{}, false
+	}
+	for _, q := range ps {
+		if q.X < p.X || q.X == p.X && q.Y > p.Y {
+			return q, true
+		}
+	}
+	return ps[0], true
+}
+
+// Draw a line between the centres of two cells, with a box at the destination end.
+func drawConnection(im draw.Image, from, to image.Rectangle, c color.NRGBA) {
+	center := func(r image.Rectangle) image.Point {
+		return r.Min.Add(r.Max).Div(2)
+	}
+	p, q := center(from), center(to)
+	src := image.NewUniform(c)
+	drawLine(im, p, q, 3, src)
+	draw.Draw(im, image.Rect(q.X-5, q.Y-5, q.X+5, q.Y+5), src, image.ZP, draw.Over)
+}
+
+// Draw a line of the given width from p to q.
+func drawLine(im draw.Image, p, q image.Point, width int, src image.Image) {
+	dx, dy := q.X-p.X, q.Y-p.Y
+	n := abs(dx)
+	if abs(dy) > n {
+		n = abs(dy)
+	}
+	if n == 0 {
+		n = 1
+	}
+	for i := 0; i <= n; i++ {
+		x := p.X + dx*i/n
+		y := p.Y + dy*i/n
+		r := image.Rect(x-width/2, y-width/2, x-width/2+width, y-width/2+width)
+		draw.Draw(im, r, src, image.ZP, draw.Src)
+	}
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
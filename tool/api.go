@@ -0,0 +1,375 @@
+package main
+
+// JSON API for the level server
+//
+//    GET api/levels                    list levels
+//    GET api/levels/<id>               metadata, tile inventory, and Check warnings
+//    GET api/levels/<id>/conversion    C2M conversion status and the encoded C2M file
+//    GET api/levels/<id>/tiles         every tile in every layer, for the viewer
+//
+// The level list comes from the server's index, in id order.
+// It is paginated with offset and limit, and can be filtered by
+//
+//    author=                  author name (exact, case insensitive)
+//    name=                    part of the level name (case insensitive)
+//    minwidth=, maxwidth=     level width
+//    minheight=, maxheight=   level height
+//    tile=                    tile types which must be present (comma separated or repeated)
+//
+// The tile filter only matches levels that the index has finished reading.
+// Errors are returned as {"error": "message"}.
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/magical/cc3d"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 1000
+)
+
+type apiLevelSummary struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Author string `json:"author"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+type apiLevelList struct {
+	Total  int               `json:"total"` // number of levels matching the filters
+	Offset int               `json:"offset"`
+	Limit  int               `json:"limit"`
+	Levels []apiLevelSummary `json:"levels"`
+}
+
+type apiLevel struct {
+	apiLevelSummary
+	Background int            `json:"background"`
+	Modified   *time.Time     `json:"modified,omitempty"`
+	Inventory  []apiTileCount `json:"inventory"`
+	Warnings   []apiWarning   `json:"warnings"`
+}
+
+type apiTileCount struct {
+	Layer string `json:"layer"`
+	Type  int    `json:"type"`
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// A warning from cc3d.Diagnose.
+// Warnings about the whole level have no layer.
+type apiWarning struct {
+	Layer   string `json:"layer,omitempty"`
+	X       int    `json:"x"`
+	Y       int    `json:"y"`
+	Message string `json:"message"`
+}
+
+// The tiles of a level, with layers in drawing order from bottom to top.
+type apiLevelTiles struct {
+	ID     string     `json:"id"`
+	Width  int        `json:"width"`
+	Height int        `json:"height"`
+	Layers []apiLayer `json:"layers"`
+}
+
+type apiLayer struct {
+	Name  string    `json:"name"`
+	Tiles []apiTile `json:"tiles"`
+}
+
+type apiTile struct {
+	Index          int               `json:"index"` // position in the layer in the level file
+	X              int               `json:"x"`
+	Y              int               `json:"y"`
+	Type           int               `json:"type"`
+	TypeName       string            `json:"type_name"` // the usual name for the type
+	Name           string            `json:"name"`      // the tile's name attribute
+	Direction      int               `json:"direction"`
+	Flags          uint64            `json:"flags"`
+	ImageIndex     int               `json:"image_index"`
+	EditorCategory int               `json:"editor_category"`
+	Extra          map[string]string `json:"extra,omitempty"` // unrecognized attributes
+}
+
+type apiConversion struct {
+	Converted bool   `json:"converted"`
+	Error     string `json:"error,omitempty"`
+	C2M       []byte `json:"c2m,omitempty"` // base64
+}
+
+func serveAPINotFound(w http.ResponseWriter, req *http.Request) {
+	writeJSONError(w, &httpError{http.StatusNotFound, errors.New("not found")})
+}
+
+// A filter on the level list.
+type levelFilter struct {
+	author, name                             string
+	minWidth, maxWidth, minHeight, maxHeight int
+	tiles                                    []int
+}
+
+func levelFilterFromQuery(q url.Values) (levelFilter, error) {
+	f := levelFilter{
+		author: strings.ToLower(q.Get("author")),
+		name:   strings.ToLower(q.Get("name")),
+	}
+	var err error
+	for _, p := range []struct {
+		name string
+		v    *int
+		def  int
+	}{
+		{"minwidth", &f.minWidth, 0},
+		{"maxwidth", &f.maxWidth, -1},
+		{"minheight", &f.minHeight, 0},
+		{"maxheight", &f.maxHeight, -1},
+	} {
+		if *p.v, err = intParam(q, p.name, p.def); err != nil {
+			return f, err
+		}
+	}
+	for _, v := range q["tile"] {
+		for _, t := range strings.Split(v, ",") {
+			typ, err := strconv.Atoi(strings.TrimSpace(t))
+			if err != nil {
+				return f, fmt.Errorf("invalid tile type %q", t)
+			}
+			f.tiles = append(f.tiles, typ)
+		}
+	}
+	return f, nil
+}
+
+func (f *levelFilter) match(li levelInfo) bool {
+	if f.author != "" && strings.ToLower(li.Author) != f.author {
+		return false
+	}
+	if f.name != "" && !strings.Contains(strings.ToLower(li.Name), f.name) {
+		return false
+	}
+	if li.Width < f.minWidth || f.maxWidth >= 0 && li.Width > f.maxWidth {
+		return false
+	}
+	if li.Height < f.minHeight || f.maxHeight >= 0 && li.Height > f.maxHeight {
+		return false
+	}
+	for _, t := range f.tiles {
+		if !li.Types[t] {
+			return false
+		}
+	}
+	return true
+}
+
+// Parse a non-negative integer query parameter.
+func intParam(q url.Values, name string, def int) (int, error) {
+	v := q.Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s: %q", name, v)
+	}
+	return n, nil
+}
+
+func (s *server) serveAPILevels(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	filter, err := levelFilterFromQuery(q)
+	if err != nil {
+		writeJSONError(w, &httpError{http.StatusBadRequest, err})
+		return
+	}
+	offset, err := intParam(q, "offset", 0)
+	if err != nil {
+		writeJSONError(w, &httpError{http.StatusBadRequest, err})
+		return
+	}
+	limit, err := intParam(q, "limit", defaultPageSize)
+	if err != nil {
+		writeJSONError(w, &httpError{http.StatusBadRequest, err})
+		return
+	}
+	limit = clamp(limit, 1, maxPageSize)
+
+	var levels []apiLevelSummary
+	for _, li := range s.index.all() {
+		if filter.match(li) {
+			levels = append(levels, apiLevelSummary{
+				ID:     li.ID,
+				Name:   li.Name,
+				Author: li.Author,
+				Width:  li.Width,
+				Height: li.Height,
+			})
+		}
+	}
+	sort.Slice(levels, func(i, j int) bool {
+		return idLess(levels[i].ID, levels[j].ID)
+	})
+	list := apiLevelList{Total: len(levels), Offset: offset, Limit: limit, Levels: []apiLevelSummary{}}
+	if offset < len(levels) {
+		levels = levels[offset:]
+		if len(levels) > limit {
+			levels = levels[:limit]
+		}
+		list.Levels = levels
+	}
+	writeJSON(w, list)
+}
+
+func (s *server) serveAPILevel(w http.ResponseWriter, req *http.Request, id string) {
+	s.serveCached(w, req, "api-level", "application/json", []string{id}, func() ([]byte, time.Time, error) {
+		m, err := s.loadLevel(id)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		level := apiLevel{
+			apiLevelSummary: apiLevelSummary{
+				ID:     id,
+				Name:   m.Name,
+				Author: m.Author,
+				Width:  m.Width,
+				Height: m.Height,
+			},
+			Background: m.Background,
+			Inventory:  inventory(m.Map),
+		}
+		if !m.ModTime.IsZero() {
+			level.Modified = &m.ModTime
+		}
+		level.Warnings = diagnose(m.Map)
+		data, err := json.Marshal(level)
+		return data, m.ModTime, err
+	})
+}
+
+// Check the level for problems.
+func diagnose(m *cc3d.Map) []apiWarning {
+	warnings := []apiWarning{}
+	for _, d := range cc3d.Diagnose(m) {
+		warnings = append(warnings, apiWarning{d.Layer, d.X, d.Y, d.Message})
+	}
+	return warnings
+}
+
+// Count the tiles of each type in each layer.
+func inventory(m *cc3d.Map) []apiTileCount {
+	counts := []apiTileCount{}
+	for _, l := range m.Layers() {
+		n := make(map[int]int)
+		for _, t := range l.Tiles {
+			n[t.Type]++
+		}
+		start := len(counts)
+		for typ, count := range n {
+			counts = append(counts, apiTileCount{l.Name, typ, cc3d.TileName(typ), count})
+		}
+		sort.Slice(counts[start:], func(i, j int) bool {
+			return counts[start+i].Type < counts[start+j].Type
+		})
+	}
+	return counts
+}
+
+func (s *server) serveAPIConversion(w http.ResponseWriter, req *http.Request, id string) {
+	s.serveCached(w, req, "api-conversion", "application/json", []string{id}, func() ([]byte, time.Time, error) {
+		m, err := s.loadLevel(id)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		var conv apiConversion
+		conv.C2M, err = encodeLevel(m.Map)
+		if err != nil {
+			conv.Error = err.Error()
+		} else {
+			conv.Converted = true
+		}
+		data, err := json.Marshal(conv)
+		return data, m.ModTime, err
+	})
+}
+
+func (s *server) serveAPITiles(w http.ResponseWriter, req *http.Request, id string) {
+	s.serveCached(w, req, "api-tiles", "application/json", []string{id}, func() ([]byte, time.Time, error) {
+		m, err := s.loadLevel(id)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		layers := make(map[string][]cc3d.Tile)
+		for _, l := range m.Layers() {
+			layers[l.Name] = l.Tiles
+		}
+		level := apiLevelTiles{ID: id, Width: m.Width, Height: m.Height}
+		for _, name := range drawOrder {
+			l := apiLayer{Name: name, Tiles: []apiTile{}}
+			for i, t := range layers[name] {
+				at := apiTile{
+					Index:          i,
+					X:              t.X / 64,
+					Y:              t.Y / 64,
+					Type:           t.Type,
+					TypeName:       cc3d.TileName(t.Type),
+					Name:           t.Attributes.Name,
+					Direction:      t.Direction,
+					Flags:          t.Attributes.Flags,
+					ImageIndex:     t.ImageIndex,
+					EditorCategory: t.Attributes.EditorCategory,
+				}
+				for _, attrs := range [][]xml.Attr{t.Extra, t.Attributes.Extra} {
+					for _, attr := range attrs {
+						if at.Extra == nil {
+							at.Extra = make(map[string]string)
+						}
+						at.Extra[attr.Name.Local] = attr.Value
+					}
+				}
+				l.Tiles = append(l.Tiles, at)
+			}
+			level.Layers = append(level.Layers, l)
+		}
+		data, err := json.Marshal(level)
+		return data, m.ModTime, err
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	writeJSONStatus(w, http.StatusOK, v)
+}
+
+func writeJSONStatus(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		// too late to change the response
+		return
+	}
+}
+
+// Write an error response as JSON, like writeError.
+func writeJSONError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	var herr *httpError
+	if errors.As(err, &herr) {
+		code = herr.code
+	} else {
+		log.Println(err)
+	}
+	writeJSONStatus(w, code, map[string]string{"error": err.Error()})
+}
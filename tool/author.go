@@ -0,0 +1,155 @@
+package main
+
+// Author pages
+//
+//    author/          every author, with the number of levels they made
+//    author/<name>    an author's levels
+//    author/-         levels with no author
+//
+// Authors are grouped by their normalized name, ignoring case and spacing,
+// since the same person often typed their name slightly differently.
+// Pages are shown under the most common spelling.
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Normalize an author name for grouping:
+// lower case, with runs of whitespace collapsed to a single space.
+func normalizeAuthor(s string) string {
+	return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+}
+
+type authorInfo struct {
+	key    string // normalized name
+	name   string // most common spelling
+	levels []levelInfo
+}
+
+// Returns the author with the given normalized name,
+// with their levels in id order.
+func (x *levelIndex) author(key string) (authorInfo, bool) {
+	x.mu.RLock()
+	ids := x.authors[key]
+	a := authorInfo{key: key}
+	for id := range ids {
+		a.levels = append(a.levels, x.levels[id])
+	}
+	x.mu.RUnlock()
+	if len(a.levels) == 0 {
+		return a, false
+	}
+	sort.Slice(a.levels, func(i, j int) bool { return idLess(a.levels[i].ID, a.levels[j].ID) })
+	a.name = commonSpelling(a.levels)
+	return a, true
+}
+
+// Returns every author, sorted by name.
+func (x *levelIndex) allAuthors() []authorInfo {
+	x.mu.RLock()
+	keys := make([]string, 0, len(x.authors))
+	for key := range x.authors {
+		keys = append(keys, key)
+	}
+	x.mu.RUnlock()
+	sort.Strings(keys)
+	var authors []authorInfo
+	for _, key := range keys {
+		if a, ok := x.author(key); ok {
+			authors = append(authors, a)
+		}
+	}
+	return authors
+}
+
+// Returns the most common spelling of the author's name,
+// preferring the earliest level in case of a tie.
+func commonSpelling(levels []levelInfo) string {
+	counts := make(map[string]int)
+	best := ""
+	for _, li := range levels {
+		counts[li.Author]++
+		if counts[li.Author] > counts[best] {
+			best = li.Author
+		}
+	}
+	// Blank names are shown as "Author Unknown"
+	return strings.TrimSpace(best)
+}
+
+// Link to an author's page, relative to author/.
+func authorLink(author string) string {
+	return url.PathEscape(authorSlug(author))
+}
+
+// Returns the name used for an author in URLs: their normalized name,
+// or "-" for levels with no author. Names which start with "-" get another one.
+func authorSlug(author string) string {
+	key := normalizeAuthor(author)
+	if key == "" || strings.HasPrefix(key, "-") {
+		key = "-" + key
+	}
+	return key
+}
+
+// Returns the normalized author name for a slug made by authorSlug.
+func authorKey(slug string) string {
+	return normalizeAuthor(strings.TrimPrefix(slug, "-"))
+}
+
+type authorsPage struct {
+	pageData
+	Authors []authorEntry
+}
+
+type authorEntry struct {
+	Link, Name string
+	Levels     int
+}
+
+func (s *server) serveAuthors(w http.ResponseWriter, req *http.Request) {
+	page := authorsPage{pageData: s.pageData(req)}
+	for _, a := range s.index.allAuthors() {
+		page.Authors = append(page.Authors, authorEntry{authorLink(a.name), a.name, len(a.levels)})
+	}
+	s.templates.render(w, "authors", page)
+}
+
+type authorPage struct {
+	pageData
+	Name   string
+	Pack   string // link to a ZIP of the author's levels
+	Levels []levelEntry
+}
+
+func (s *server) serveAuthor(w http.ResponseWriter, req *http.Request, slug string) {
+	a, ok := s.index.author(authorKey(slug))
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	page := authorPage{
+		pageData: s.pageData(req),
+		Name:     a.name,
+		Pack:     "pack.zip?author=" + url.QueryEscape(authorSlug(a.name)),
+	}
+	for _, li := range a.levels {
+		e := entryFor(li)
+		if li.Complete {
+			if li.Converts {
+				e.Note = "Converts to C2M"
+			} else {
+				e.Note = "Doesn't convert to C2M"
+			}
+			if li.Warnings > 0 {
+				e.Note += fmt.Sprintf(", %d warnings", li.Warnings)
+			}
+		}
+		page.Levels = append(page.Levels, e)
+	}
+	s.templates.render(w, "author", page)
+}
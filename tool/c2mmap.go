@@ -0,0 +1,113 @@
+package main
+
+// Maps of converted C2M levels
+//
+// These use a separate tileset whose tile types are C2M tile IDs,
+// so that conversion problems show up as they would in CC2 or Lexy's Labyrinth.
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math/bits"
+	"strconv"
+
+	"github.com/magical/cc3d"
+	"github.com/magical/cc3d/c2m"
+)
+
+const (
+	c2mThinWall      = 0x6D
+	c2mCloneMachine  = 0x44
+	c2mSokobanBlock  = 0xF1
+	c2mSokobanButton = 0xF2
+	c2mSokobanWall   = 0xF3
+)
+
+// Sokoban colours, indexed by the tile's flags
+var sokobanColors = []color.RGBA{
+	{0xff, 0x5a, 0x4a, 0xff}, // red
+	{0x5a, 0x8c, 0xff, 0xff}, // blue
+	{0xf0, 0xe0, 0x40, 0xff}, // yellow
+	{0x4c, 0xd9, 0x64, 0xff}, // green
+}
+
+var (
+	thinWallColor = color.RGBA{0x80, 0x20, 0xa0, 0xff}
+	unknownColor  = color.NRGBA{0xff, 0, 0xff, 0x80}
+)
+
+// Draw a C2M level.
+// Tiles which have no image are drawn as a magenta square labelled with their ID.
+func makeC2MMap(m *c2m.Map, tileset Tileset) *image.RGBA {
+	size := tileset.TileSize()
+	im := image.NewRGBA(image.Rect(0, 0, m.Width*size, m.Height*size))
+	tinted := make(map[[2]int]image.Image)
+	for i, stack := range m.Tiles {
+		x, y := i%m.Width*size, i/m.Width*size
+		r := image.Rect(x, y, x+size, y+size)
+		// stacks go from bottom to top
+		for _, t := range stack {
+			if t.ID == c2mThinWall {
+				drawThinWalls(im, r, t.Flags)
+				continue
+			}
+			ct := cc3d.Tile{Type: int(t.ID), Direction: int(t.Dir)}
+			src := tileset.TileImage(ct)
+			if src == nil {
+				draw.Draw(im, r, image.NewUniform(unknownColor), image.ZP, draw.Over)
+				drawOutlinedText(im, r.Min.Add(image.Pt(size/12, size/12)), strconv.Itoa(int(t.ID)), 1+size/48, color.White, color.Black)
+				continue
+			}
+			switch t.ID {
+			case c2mSokobanBlock, c2mSokobanButton, c2mSokobanWall:
+				if int(t.Flags) < len(sokobanColors) {
+					key := [2]int{int(t.ID), int(t.Flags)}
+					if tinted[key] == nil {
+						rgba := image.NewRGBA(image.Rect(0, 0, size, size))
+						draw.Draw(rgba, rgba.Rect, src, src.Bounds().Min, draw.Src)
+						tint(rgba, sokobanColors[t.Flags])
+						tinted[key] = rgba
+					}
+					src = tinted[key]
+				}
+			}
+			draw.Draw(im, r, src, src.Bounds().Min, draw.Over)
+			if t.ID == c2mCloneMachine {
+				// Clone machines store the directions they clone in as flags
+				for f := t.Flags; f != 0; f &= f - 1 {
+					ct.Direction = bits.TrailingZeros32(f)
+					if dir := tileset.Direction(ct); dir != nil {
+						draw.Draw(im, r, dir, image.ZP, draw.Over)
+					}
+				}
+			} else if t.HasDir() {
+				if dir := tileset.Direction(ct); dir != nil {
+					draw.Draw(im, r, dir, image.ZP, draw.Over)
+				}
+			}
+		}
+	}
+	return im
+}
+
+// Draw thin walls along the edges of r.
+// The low four bits of flags are north, east, south, and west.
+func drawThinWalls(im draw.Image, r image.Rectangle, flags uint32) {
+	t := r.Dx() / 8
+	if t < 1 {
+		t = 1
+	}
+	src := image.NewUniform(thinWallColor)
+	edges := [4]image.Rectangle{
+		{r.Min, image.Pt(r.Max.X, r.Min.Y+t)},
+		{image.Pt(r.Max.X-t, r.Min.Y), r.Max},
+		{image.Pt(r.Min.X, r.Max.Y-t), r.Max},
+		{r.Min, image.Pt(r.Min.X+t, r.Max.Y)},
+	}
+	for i, e := range edges {
+		if flags&(1<<uint(i)) != 0 {
+			draw.Draw(im, e, src, image.ZP, draw.Src)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+// Rendered image cache for the HTTP server
+//
+// Rendering a map means reading, parsing, and drawing the level and encoding
+// a PNG, which is slow enough to notice when an index page asks for a hundred
+// thumbnails. Results are kept in a size-bounded in-memory LRU cache and,
+// if -cachedir is given, in a directory on disk which survives restarts.
+//
+// Entries are keyed by the level files' modification times and sizes
+// along with the request's render options, so a changed level is never
+// served stale; old entries just age out. The key also determines the ETag,
+// so conditional requests can be answered without rendering anything.
+//
+// Bump cacheVersion when a change to the renderer should invalidate
+// images that are already on disk.
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const cacheVersion = 1
+
+var (
+	cacheSizeFlag    = flag.Int("cachesize", 64, "size of the in-memory render cache for -http, in megabytes")
+	cacheDirFlag     = flag.String("cachedir", "", "directory to cache rendered images in for -http")
+	cacheDirSizeFlag = flag.Int("cachedirsize", 1024, "maximum size of -cachedir, in megabytes")
+)
+
+type cacheEntry struct {
+	key     string
+	data    []byte
+	modTime time.Time
+}
+
+// A renderCache is an LRU cache of rendered files,
+// optionally backed by a directory.
+type renderCache struct {
+	mu      sync.Mutex
+	max     int64
+	size    int64
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+
+	dir      string
+	maxDisk  int64
+	diskSize int64
+}
+
+// Create a render cache holding up to max bytes in memory.
+// If dir is not empty, entries are also stored there, up to maxDisk bytes.
+func newRenderCache(max int64, dir string, maxDisk int64) (*renderCache, error) {
+	c := &renderCache{
+		max:     max,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		dir:     dir,
+		maxDisk: maxDisk,
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return nil, err
+		}
+		c.diskSize = c.prune(maxDisk)
+	}
+	return c, nil
+}
+
+// Look up an entry by key.
+func (c *renderCache) get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(el)
+		c.mu.Unlock()
+		return el.Value.(*cacheEntry), true
+	}
+	c.mu.Unlock()
+	if c.dir == "" {
+		return nil, false
+	}
+	e, err := c.readFile(key)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Println("cache:", err)
+		}
+		return nil, false
+	}
+	c.add(e)
+	return e, true
+}
+
+// Add an entry to the cache.
+func (c *renderCache) put(key string, data []byte, modTime time.Time) *cacheEntry {
+	e := &cacheEntry{key: key, data: data, modTime: modTime}
+	c.add(e)
+	if c.dir != "" {
+		if err := c.writeFile(e); err != nil {
+			log.Println("cache:", err)
+		}
+	}
+	return e
+}
+
+// Add an entry to the in-memory cache, evicting old entries to make room.
+func (c *renderCache) add(e *cacheEntry) {
+	n := int64(len(e.data))
+	if n > c.max {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.key]; ok {
+		c.size -= int64(len(el.Value.(*cacheEntry).data))
+		c.lru.Remove(el)
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.size += n
+	for c.size > c.max {
+		el := c.lru.Back()
+		old := el.Value.(*cacheEntry)
+		c.lru.Remove(el)
+		delete(c.entries, old.key)
+		c.size -= int64(len(old.data))
+	}
+}
+
+// Remove every in-memory entry rendered from the given level file.
+// Entries on disk can't be found by file, so they're left to be pruned.
+func (c *renderCache) forget(filename string) {
+	abs, _ := filepath.Abs(filename)
+	needle := "\x00" + abs + "\x00"
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, el := range c.entries {
+		if strings.Contains(key, needle) {
+			c.size -= int64(len(el.Value.(*cacheEntry).data))
+			c.lru.Remove(el)
+			delete(c.entries, key)
+		}
+	}
+}
+
+type cacheStats struct {
+	Entries   int   `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+	DiskBytes int64 `json:"disk_bytes,omitempty"`
+}
+
+func (c *renderCache) stats() cacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return cacheStats{len(c.entries), c.size, c.diskSize}
+}
+
+// Files on disk start with the entry's modification time
+// in nanoseconds since the epoch.
+func (c *renderCache) filename(key string) string {
+	return filepath.Join(c.dir, cacheHash(key)+".cache")
+}
+
+func (c *renderCache) readFile(key string) (*cacheEntry, error) {
+	b, err := os.ReadFile(c.filename(key))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 8 {
+		return nil, fmt.Errorf("%s: truncated cache file", c.filename(key))
+	}
+	var modTime time.Time
+	if t := int64(binary.BigEndian.Uint64(b)); t != 0 {
+		modTime = time.Unix(0, t).UTC()
+	}
+	return &cacheEntry{key: key, data: b[8:], modTime: modTime}, nil
+}
+
+func (c *renderCache) writeFile(e *cacheEntry) error {
+	var hdr [8]byte
+	if !e.modTime.IsZero() {
+		binary.BigEndian.PutUint64(hdr[:], uint64(e.modTime.UnixNano()))
+	}
+	// Write to a temporary file and rename it so that
+	// readers never see a partially written file
+	f, err := os.CreateTemp(c.dir, "tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(hdr[:])
+	if err == nil {
+		_, err = f.Write(e.data)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.filename(e.key))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	c.mu.Lock()
+	c.diskSize += int64(len(hdr) + len(e.data))
+	full := c.diskSize > c.maxDisk
+	c.mu.Unlock()
+	if full {
+		// Prune to 90% so we don't have to do this on every write
+		size := c.prune(c.maxDisk * 9 / 10)
+		c.mu.Lock()
+		c.diskSize = size
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// Remove the oldest files from the cache directory
+// until it holds at most max bytes.
+// Returns the size of the remaining files.
+func (c *renderCache) prune(max int64) int64 {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		log.Println("cache:", err)
+		return 0
+	}
+	var files []os.FileInfo
+	var total int64
+	for _, de := range entries {
+		if !strings.HasSuffix(de.Name(), ".cache") {
+			continue
+		}
+		fi, err := de.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, fi)
+		total += fi.Size()
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, fi := range files {
+		if total <= max {
+			break
+		}
+		if err := os.Remove(filepath.Join(c.dir, fi.Name())); err != nil {
+			log.Println("cache:", err)
+			continue
+		}
+		total -= fi.Size()
+	}
+	return total
+}
+
+func cacheHash(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// Returns a cache key for a rendering of the given levels.
+// Returns an error if any of the level files can't be found.
+func (s *server) cacheKey(kind string, query url.Values, ids ...string) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "v%d\x00%s\x00%s\x00%s\x00%s", cacheVersion, kind, query.Encode(), *tilesetFlag, *c2mTilesetFlag)
+	for _, id := range ids {
+		filename := filepath.Join(s.levelDir, id+".xml.gz")
+		fi, err := os.Stat(filename)
+		if err != nil {
+			return "", err
+		}
+		abs, _ := filepath.Abs(filename)
+		fmt.Fprintf(&b, "\x00%s\x00%d\x00%d", abs, fi.ModTime().UnixNano(), fi.Size())
+	}
+	return b.String(), nil
+}
+
+// Serve a rendered file from the cache, rendering it if necessary.
+// The render function returns the file's contents and the time
+// the level was last modified (which may be zero if unknown).
+// Rendering errors are never cached.
+func (s *server) serveCached(w http.ResponseWriter, req *http.Request, kind, contentType string, ids []string, render func() ([]byte, time.Time, error)) {
+	fail := func(err error) {
+		if contentType == "application/json" {
+			writeJSONError(w, err)
+		} else {
+			writeError(w, err)
+		}
+	}
+	key, err := s.cacheKey(kind, req.URL.Query(), ids...)
+	if err != nil {
+		fail(&httpError{http.StatusNotFound, errors.New("404 page not found")})
+		return
+	}
+	etag := `"` + cacheHash(key)[:20] + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", contentType)
+	if etagMatch(req.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	e, ok := s.cache.get(key)
+	if !ok {
+		data, modTime, err := render()
+		if err != nil {
+			w.Header().Del("ETag")
+			w.Header().Del("Content-Type")
+			fail(err)
+			return
+		}
+		e = s.cache.put(key, data, modTime)
+	}
+	// ServeContent takes care of Last-Modified, If-Modified-Since, and ranges
+	http.ServeContent(w, req, "", e.modTime, bytes.NewReader(e.data))
+}
+
+// Reports whether an If-None-Match header matches etag.
+func etagMatch(header, etag string) bool {
+	for _, s := range strings.Split(header, ",") {
+		s = strings.TrimSpace(s)
+		if s == "*" || strings.TrimPrefix(s, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// An httpError is an error with an HTTP status code.
+type httpError struct {
+	code int
+	err  error
+}
+
+func (e *httpError) Error() string { return e.err.Error() }
+func (e *httpError) Unwrap() error { return e.err }
+
+// Write an error response.
+// Errors which aren't httpErrors are logged and reported as 500s.
+func writeError(w http.ResponseWriter, err error) {
+	var herr *httpError
+	if errors.As(err, &herr) {
+		http.Error(w, herr.Error(), herr.code)
+		return
+	}
+	log.Println(err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
@@ -9,11 +9,18 @@ var outputFlag string
 
 func main() {
 	log.SetFlags(0)
-	flag.StringVar(&outputFlag, "o", "", "output file for -map")
+	flag.StringVar(&outputFlag, "o", "", "output file for -map, -convert, -diff, -merge, or -animate")
 	listFlag := flag.Bool("info", false, "list info for one or more levels")
-	mapFlag := flag.Bool("map", false, "convert a level into an image")
+	mapFlag := flag.Bool("map", false, "convert a level into an image (PNG, or SVG if -o ends in .svg)")
 	httpFlag := flag.Bool("http", false, "serve level maps over HTTP")
 	convertFlag := flag.Bool("convert", false, "convert cc3d xml to c2m")
+	searchFlag := flag.String("search", "", "print levels matching a search query")
+	similarFlag := flag.Bool("similar", false, "find clusters of similar levels in one or more directories")
+	diffFlag := flag.Bool("diff", false, "compare two levels")
+	mergeFlag := flag.Bool("merge", false, "three-way merge of levels (base, ours, theirs)")
+	textFlag := flag.Bool("text", false, "print a level as text")
+	animateFlag := flag.String("animate", "", "write an animated GIF of the player following a list of moves (UDLR)")
+	statsFlag := flag.Bool("stats", false, "print statistics about the levels in one or more directories")
 	flag.Parse()
 	if *listFlag {
 		if *httpFlag {
@@ -36,5 +43,19 @@ func main() {
 			log.Fatal("cannot use -convert with -http or -map or -list")
 		}
 		convertMain()
+	} else if *searchFlag != "" {
+		searchMain(*searchFlag)
+	} else if *similarFlag {
+		similarMain()
+	} else if *diffFlag {
+		diffMain()
+	} else if *mergeFlag {
+		mergeMain()
+	} else if *textFlag {
+		textMain()
+	} else if *animateFlag != "" {
+		animateMain(*animateFlag)
+	} else if *statsFlag {
+		statsMain()
 	}
 }
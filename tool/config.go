@@ -0,0 +1,215 @@
+package main
+
+// Server configuration
+//
+// The -config file is JSON:
+//
+//    {
+//      "base_url": "https://levels.example.com",
+//      "upload_token": "a long random string",
+//      "collections": [
+//        {
+//          "path": "/srv/cc3d_levels",
+//          "mount": "/cc3d/",
+//          "title": "CC3D",
+//          "ids": "numeric",
+//          "breakpoints": [1004, 16501, 17001],
+//          "break_every": 250,
+//          "links": [
+//            {"label": "Replay", "url": "https://s3.amazonaws.com/cc3d-editorreplays/hint_{id}.hnt"},
+//            {"label": "chuckschallenge.com", "url": "http://beta.chuckschallenge.com/Share.php?levelId={id}", "max_id": 14999}
+//          ]
+//        }
+//      ]
+//    }
+//
+// The base URL is the scheme and host the server is reached at, plus any
+// path prefix added by a proxy. It's used for absolute links, like those
+// in the Atom feed. Without it, links use http and the request's Host header.
+//
+// Each collection is a directory of levels served under its mount point,
+// which defaults to / if there is only one collection and /<dirname>/ otherwise.
+//
+// Level ids are either "numeric" (the default), or "name", which allows
+// any file name made of letters, digits, underscores, and hyphens.
+// Names which clash with the server's own pages, like status or upload,
+// can't be used as ids.
+//
+// Breakpoints start a new group of links on the index page.
+// They only apply to numeric ids; names are grouped by their first letter.
+//
+// Links are shown on each level's page, with {id} replaced by the level id.
+// min_id and max_id restrict a link to a range of numeric ids.
+//
+// Keep the file somewhere only the server can read, since it holds the upload token.
+// Uploads are disabled unless a token is set.
+//
+// Without a config file, each directory on the command line is a collection,
+// and the title and links are guessed from the directory name.
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var configFlag = flag.String("config", "", "configuration file for -http")
+
+type serverConfig struct {
+	BaseURL     string             `json:"base_url"`
+	UploadToken string             `json:"upload_token"`
+	Collections []collectionConfig `json:"collections"`
+}
+
+type collectionConfig struct {
+	Path        string       `json:"path"`
+	Mount       string       `json:"mount"`
+	Title       string       `json:"title"`
+	IDs         string       `json:"ids"`
+	Breakpoints []int        `json:"breakpoints"`
+	BreakEvery  int          `json:"break_every"`
+	Links       []linkConfig `json:"links"`
+}
+
+// A link to another site from a level's page.
+type linkConfig struct {
+	Label string `json:"label"`
+	URL   string `json:"url"`
+	MinID int    `json:"min_id"`
+	MaxID int    `json:"max_id"`
+}
+
+// Id schemes
+const (
+	numericIDs = "numeric"
+	nameIDs    = "name"
+)
+
+// Read the -config file.
+// Returns an empty configuration if there isn't one.
+func loadServerConfig(filename string) (*serverConfig, error) {
+	config := new(serverConfig)
+	if filename == "" {
+		return config, nil
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	if err := config.check(); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return config, nil
+}
+
+// Fill in defaults and check that the collections make sense.
+func (config *serverConfig) check() error {
+	if config.BaseURL != "" {
+		u, err := url.Parse(config.BaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("base_url must be an http or https URL: %q", config.BaseURL)
+		}
+		config.BaseURL = strings.TrimRight(config.BaseURL, "/")
+	}
+	mounts := make(map[string]bool)
+	for i := range config.Collections {
+		c := &config.Collections[i]
+		if c.Path == "" {
+			return fmt.Errorf("collection %d has no path", i+1)
+		}
+		if c.Mount == "" {
+			if len(config.Collections) == 1 {
+				c.Mount = "/"
+			} else {
+				c.Mount = filepath.Base(c.Path)
+			}
+		}
+		c.Mount = cleanMount(c.Mount)
+		if mounts[c.Mount] {
+			return fmt.Errorf("more than one collection is mounted at %s", c.Mount)
+		}
+		mounts[c.Mount] = true
+		if c.Title == "" {
+			c.Title = filepath.Base(c.Path)
+		}
+		switch c.IDs {
+		case "":
+			c.IDs = numericIDs
+		case numericIDs, nameIDs:
+		default:
+			return fmt.Errorf("%s: unknown id scheme %q", c.Path, c.IDs)
+		}
+		if c.BreakEvery < 0 {
+			return fmt.Errorf("%s: break_every must not be negative", c.Path)
+		}
+		for _, l := range c.Links {
+			if l.Label == "" || l.URL == "" {
+				return fmt.Errorf("%s: links need a label and a url", c.Path)
+			}
+		}
+	}
+	return nil
+}
+
+// Turn a mount point into an absolute path ending in a slash.
+func cleanMount(mount string) string {
+	mount = path.Clean("/" + mount)
+	if mount != "/" {
+		mount += "/"
+	}
+	return mount
+}
+
+// Collections for level directories given on the command line.
+// The first directory is mounted at / if it's the only one.
+func defaultCollections(dirs []string) []collectionConfig {
+	var cs []collectionConfig
+	for _, dir := range dirs {
+		dirname := filepath.Base(dir)
+		c := collectionConfig{
+			Path:        dir,
+			Mount:       cleanMount(dirname),
+			Title:       "CC3D",
+			IDs:         numericIDs,
+			Breakpoints: []int{1004, 16501, 17001},
+			BreakEvery:  250,
+		}
+		if len(dirs) == 1 {
+			c.Mount = "/"
+		}
+		if strings.Contains(dirname, "ben10") {
+			c.Title = "Ben 10"
+		}
+		if strings.Contains(dirname, "cc3d") {
+			c.Links = cc3dLinks
+		}
+		cs = append(cs, c)
+	}
+	return cs
+}
+
+var cc3dLinks = []linkConfig{
+	{Label: "Replay", URL: "https://s3.amazonaws.com/cc3d-editorreplays/hint_{id}.hnt"},
+	{Label: "View on chuckschallenge.com", URL: "http://beta.chuckschallenge.com/Share.php?levelId={id}", MaxID: 14999},
+	{Label: "View on chuckschallenge.com", URL: "http://cc3d.chuckschallenge.com/Share.php?levelId={id}", MinID: 15000},
+}
+
+// Reports whether the link applies to the level, and if so returns its URL.
+func (l linkConfig) expand(id string) (string, bool) {
+	if l.MinID != 0 || l.MaxID != 0 {
+		n, err := strconv.Atoi(id)
+		if err != nil || (l.MinID != 0 && n < l.MinID) || (l.MaxID != 0 && n > l.MaxID) {
+			return "", false
+		}
+	}
+	return strings.ReplaceAll(l.URL, "{id}", id), true
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"flag"
 	"log"
 	"os"
@@ -55,3 +57,27 @@ func doConvert(filename, outname string) (err error) {
 	}
 	return out.Close()
 }
+
+// Convert a level to C2M, turning panics in the converter into errors.
+func convertLevel(m *cc3d.Map) (c *c2m.Map, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			log.Println("level conversion panicked:", v)
+			c, err = nil, errors.New("level conversion panicked")
+		}
+	}()
+	return cc3d.Convert(m)
+}
+
+// Convert a level and encode it as a C2M file.
+func encodeLevel(m *cc3d.Map) ([]byte, error) {
+	c, err := convertLevel(m)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := c2m.Encode(&buf, c); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
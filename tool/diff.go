@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log"
+	"os"
+
+	"github.com/magical/cc3d"
+)
+
+func diffMain() {
+	if flag.NArg() != 2 {
+		log.Fatal("usage: -diff [-o out.png] old.xml new.xml")
+	}
+	a, err := readLevelFile(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	b, err := readLevelFile(flag.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	d := cc3d.DiffLevels(a, b)
+	if _, err := d.WriteTo(os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+	if outputFlag != "" {
+		if err := checkTileSize(*sizeFlag); err != nil {
+			log.Fatal(err)
+		}
+		im, err := makeDiffMap(a, b, d, loadTiles(loadSize(*sizeFlag)), *sizeFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := writePNG(outputFlag, im); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func writePNG(filename string, im image.Image) error {
+	out, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if err := png.Encode(out, im); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+var (
+	addedColor   = color.NRGBA{0, 0xc0, 0, 0x80}
+	removedColor = color.NRGBA{0xff, 0, 0, 0x80}
+	changedColor = color.NRGBA{0xff, 0xd0, 0, 0x80}
+)
+
+// Draw the new level with the changed cells highlighted.
+// Green cells had tiles added, red cells had tiles removed,
+// and yellow cells had tiles changed (or some combination).
+// Tiles are drawn size pixels wide (see makeMap).
+func makeDiffMap(a, b *cc3d.Map, d *cc3d.Diff, tileset Tileset, size int) (*image.RGBA, error) {
+	newMap, err := makeMap(b, tileset, mapOptions{Size: size})
+	if err != nil {
+		return nil, err
+	}
+	w, h := b.Width, b.Height
+	if a.Width > w {
+		w = a.Width
+	}
+	if a.Height > h {
+		h = a.Height
+	}
+	if size <= 0 || size%tileset.TileSize() != 0 {
+		size = tileset.TileSize()
+	}
+	im := image.NewRGBA(image.Rect(0, 0, w*size, h*size))
+	draw.Draw(im, newMap.Bounds(), newMap, image.ZP, draw.Src)
+
+	kinds := make(map[image.Point]cc3d.ChangeKind)
+	for _, c := range d.Cells {
+		p := image.Pt(c.X, c.Y)
+		if k, ok := kinds[p]; ok && k != c.Kind {
+			kinds[p] = cc3d.Changed
+		} else {
+			kinds[p] = c.Kind
+		}
+	}
+	for p, k := range kinds {
+		c := changedColor
+		switch k {
+		case cc3d.Added:
+			c = addedColor
+		case cc3d.Removed:
+			c = removedColor
+		}
+		r := image.Rect(p.X*size, p.Y*size, (p.X+1)*size, (p.Y+1)*size)
+		draw.Draw(im, r, image.NewUniform(c), image.ZP, draw.Over)
+		drawBorder(im, r, c)
+	}
+	return im, nil
+}
+
+// Draw a 2px opaque border just inside r.
+func drawBorder(im draw.Image, r image.Rectangle, c color.NRGBA) {
+	c.A = 0xff
+	src := image.NewUniform(c)
+	const t = 2
+	draw.Draw(im, image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+t), src, image.ZP, draw.Src)
+	draw.Draw(im, image.Rect(r.Min.X, r.Max.Y-t, r.Max.X, r.Max.Y), src, image.ZP, draw.Src)
+	draw.Draw(im, image.Rect(r.Min.X, r.Min.Y, r.Min.X+t, r.Max.Y), src, image.ZP, draw.Src)
+	draw.Draw(im, image.Rect(r.Max.X-t, r.Min.Y, r.Max.X, r.Max.Y), src, image.ZP, draw.Src)
+}
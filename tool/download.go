@@ -0,0 +1,176 @@
+package main
+
+// Downloads of converted levels
+//
+//    <id>.c2m                   a level converted to C2M
+//    pack.zip?ids=1,2,3         a ZIP of the given levels
+//    pack.zip?author=<name>     a ZIP of an author's levels, named as in author/<name>
+//
+// A pack holds each level as a .c2m file and as the original XML,
+// along with a .c2g script which plays the converted levels in order,
+// so it can be unzipped and played in CC2 or Lexy's Labyrinth.
+// Levels which don't convert are listed in errors.txt.
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/magical/cc3d"
+)
+
+const maxPackLevels = 500
+
+// Serve a level converted to C2M.
+func (s *server) serveC2M(w http.ResponseWriter, req *http.Request, id string) {
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.c2m\"", id))
+	s.serveCached(w, req, "c2m-file", "application/octet-stream", []string{id}, func() ([]byte, time.Time, error) {
+		m, err := s.loadLevel(id)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		b, err := encodeLevel(m.Map)
+		if err != nil {
+			return nil, time.Time{}, &httpError{http.StatusUnprocessableEntity, err}
+		}
+		return b, m.ModTime, nil
+	})
+}
+
+// Read a level's decompressed XML.
+func (s *server) readLevelXML(id string) ([]byte, error) {
+	f, err := os.Open(filepath.Join(s.levelDir, id+".xml.gz"))
+	if err != nil {
+		return nil, &httpError{http.StatusNotFound, errors.New("404 page not found")}
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(zr)
+}
+
+// Serve a ZIP of the levels selected by the ids or author query parameter.
+func (s *server) servePack(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	var ids []string
+	title := s.title + " levels"
+	filename := "pack"
+	if author := q.Get("author"); author != "" {
+		a, ok := s.index.author(authorKey(author))
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		for _, li := range a.levels {
+			ids = append(ids, li.ID)
+		}
+		title = "Levels by " + def(a.name, "Author Unknown")
+		filename = safeFilename(a.name)
+	} else {
+		// Each level goes in the pack once, in the order it was first listed
+		seen := make(map[string]bool)
+		for _, v := range strings.Split(q.Get("ids"), ",") {
+			if v = strings.TrimSpace(v); v != "" && !seen[v] {
+				if !s.isID(v) {
+					http.Error(w, fmt.Sprintf("invalid level id %q", v), http.StatusBadRequest)
+					return
+				}
+				seen[v] = true
+				ids = append(ids, v)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		http.Error(w, "no levels selected; use ?ids= or ?author=", http.StatusBadRequest)
+		return
+	}
+	if len(ids) > maxPackLevels {
+		http.Error(w, fmt.Sprintf("too many levels: %d > %d", len(ids), maxPackLevels), http.StatusBadRequest)
+		return
+	}
+	for _, id := range ids {
+		if _, err := os.Stat(filepath.Join(s.levelDir, id+".xml.gz")); err != nil {
+			http.Error(w, fmt.Sprintf("level %s not found", id), http.StatusNotFound)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.zip\"", filename))
+	if err := s.writePack(w, title, filename, ids); err != nil {
+		log.Println(err)
+		// too late to change the response
+	}
+}
+
+func (s *server) writePack(w io.Writer, title, filename string, ids []string) error {
+	zw := zip.NewWriter(w)
+	var script bytes.Buffer
+	var errs bytes.Buffer
+	fmt.Fprintf(&script, "game %q\n", strings.ReplaceAll(title, `"`, ""))
+	for _, id := range ids {
+		xml, err := s.readLevelXML(id)
+		if err != nil {
+			fmt.Fprintf(&errs, "%s: %v\n", id, err)
+			continue
+		}
+		if err := writeZipFile(zw, "xml/"+id+".xml", xml); err != nil {
+			return err
+		}
+		m, err := cc3d.ReadLevel(bytes.NewReader(xml))
+		if err != nil {
+			fmt.Fprintf(&errs, "%s: %v\n", id, err)
+			continue
+		}
+		c2m, err := encodeLevel(m)
+		if err != nil {
+			fmt.Fprintf(&errs, "%s: %v\n", id, err)
+			continue
+		}
+		if err := writeZipFile(zw, id+".c2m", c2m); err != nil {
+			return err
+		}
+		fmt.Fprintf(&script, "map %q\n", id+".c2m")
+	}
+	if err := writeZipFile(zw, filename+".c2g", script.Bytes()); err != nil {
+		return err
+	}
+	if errs.Len() > 0 {
+		if err := writeZipFile(zw, "errors.txt", errs.Bytes()); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func writeZipFile(zw *zip.Writer, name string, data []byte) error {
+	fw, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = fw.Write(data)
+	return err
+}
+
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// Turn a name into something safe to use as a file name.
+func safeFilename(name string) string {
+	name = strings.Trim(unsafeFilenameChars.ReplaceAllString(name, "_"), "_.")
+	if name == "" {
+		name = "pack"
+	}
+	return name
+}
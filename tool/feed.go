@@ -0,0 +1,107 @@
+package main
+
+// Atom feed of the newest levels in a directory, at feed.atom.
+//
+// Levels are dated by the modification time in their gzip header,
+// falling back to the file's modification time.
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const maxFeedEntries = 50
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Content atomContent `xml:"content"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+func (s *server) serveFeed(w http.ResponseWriter, req *http.Request) {
+	levels := s.index.all()
+	sort.Slice(levels, func(i, j int) bool {
+		if !levels[i].Modified.Equal(levels[j].Modified) {
+			return levels[i].Modified.After(levels[j].Modified)
+		}
+		return idLess(levels[j].ID, levels[i].ID)
+	})
+	if len(levels) > maxFeedEntries {
+		levels = levels[:maxFeedEntries]
+	}
+
+	// Atom wants absolute URLs
+	base := s.absURL(req, "")
+	feed := atomFeed{
+		Title: s.title + " levels",
+		ID:    base + "feed.atom",
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: base + "feed.atom"},
+			{Rel: "alternate", Type: "text/html", Href: base},
+		},
+	}
+	var updated time.Time
+	for _, li := range levels {
+		if li.Modified.After(updated) {
+			updated = li.Modified
+		}
+		info := base + li.ID
+		content := fmt.Sprintf(`<p><a href="%s"><img src="%s_thumb.png" alt=""></a>`, escape(info), escape(info))
+		content += fmt.Sprintf("<p>%dx%d", li.Width, li.Height)
+		links := []atomLink{{Rel: "alternate", Type: "text/html", Href: info}}
+		if li.Converts {
+			if conv := s.conversion(li.ID, nil); conv.LexyURL != "" {
+				content += fmt.Sprintf(`<p><a href="%s">Play in Lexy's Labyrinth</a>`, escape(conv.LexyURL))
+				links = append(links, atomLink{Rel: "related", Type: "text/html", Href: conv.LexyURL})
+			}
+		}
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:   def(li.Name, "Untitled"),
+			ID:      info,
+			Updated: li.Modified.Format(time.RFC3339),
+			Author:  atomAuthor{def(li.Author, "Author Unknown")},
+			Links:   links,
+			Content: atomContent{"html", content},
+		})
+	}
+	feed.Updated = updated.Format(time.RFC3339)
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(feed); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+// A tiny bitmap font for labelling tiles and coordinates
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+const (
+	glyphWidth  = 3
+	glyphHeight = 5
+)
+
+// Each glyph is 5 rows of 3 pixels, most significant bit on the left.
+var glyphs = map[rune][glyphHeight]uint8{
+	'0': {7, 5, 5, 5, 7},
+	'1': {2, 6, 2, 2, 7},
+	'2': {7, 1, 7, 4, 7},
+	'3': {7, 1, 3, 1, 7},
+	'4': {5, 5, 7, 1, 1},
+	'5': {7, 4, 7, 1, 7},
+	'6': {7, 4, 7, 5, 7},
+	'7': {7, 1, 1, 2, 2},
+	'8': {7, 5, 7, 5, 7},
+	'9': {7, 5, 7, 1, 7},
+	'A': {2, 5, 7, 5, 5},
+	'B': {6, 5, 6, 5, 6},
+	'C': {3, 4, 4, 4, 3},
+	'D': {6, 5, 5, 5, 6},
+	'E': {7, 4, 6, 4, 7},
+	'F': {7, 4, 6, 4, 4},
+	'G': {3, 4, 5, 5, 3},
+	'H': {5, 5, 7, 5, 5},
+	'I': {7, 2, 2, 2, 7},
+	'J': {1, 1, 1, 5, 2},
+	'K': {5, 5, 6, 5, 5},
+	'L': {4, 4, 4, 4, 7},
+	'M': {5, 7, 7, 5, 5},
+	'N': {6, 5, 5, 5, 5},
+	'O': {2, 5, 5, 5, 2},
+	'P': {6, 5, 6, 4, 4},
+	'Q': {2, 5, 5, 6, 3},
+	'R': {6, 5, 6, 5, 5},
+	'S': {3, 4, 2, 1, 6},
+	'T': {7, 2, 2, 2, 2},
+	'U': {5, 5, 5, 5, 7},
+	'V': {5, 5, 5, 5, 2},
+	'W': {5, 5, 7, 7, 5},
+	'X': {5, 5, 2, 5, 5},
+	'Y': {5, 5, 2, 2, 2},
+	'Z': {7, 1, 2, 4, 7},
+	',': {0, 0, 0, 2, 4},
+	'-': {0, 0, 7, 0, 0},
+	'?': {7, 1, 2, 0, 2},
+	'!': {2, 2, 2, 0, 2},
+}
+
+// Returns the size of text drawn at the given scale.
+func textSize(s string, scale int) image.Point {
+	n := len([]rune(s))
+	if n == 0 {
+		return image.Point{}
+	}
+	return image.Pt((n*(glyphWidth+1)-1)*scale, glyphHeight*scale)
+}
+
+// Draw text with its top left corner at p.
+// Each pixel of the font is drawn as a scale x scale square.
+// Characters without a glyph are drawn as '?'.
+func drawText(im draw.Image, p image.Point, s string, scale int, c color.Color) {
+	src := image.NewUniform(c)
+	for _, r := range s {
+		g, ok := glyphs[r]
+		if !ok {
+			g = glyphs['?']
+		}
+		for y := 0; y < glyphHeight; y++ {
+			for x := 0; x < glyphWidth; x++ {
+				if g[y]&(4>>uint(x)) != 0 {
+					r := image.Rect(p.X+x*scale, p.Y+y*scale, p.X+(x+1)*scale, p.Y+(y+1)*scale)
+					draw.Draw(im, r, src, image.ZP, draw.Over)
+				}
+			}
+		}
+		p.X += (glyphWidth + 1) * scale
+	}
+}
+
+// Draw text with a one pixel (times scale) outline, for legibility on busy backgrounds.
+func drawOutlinedText(im draw.Image, p image.Point, s string, scale int, fg, outline color.Color) {
+	for _, d := range []image.Point{{-1, 0}, {1, 0}, {0, -1}, {0, 1}, {-1, -1}, {1, 1}, {-1, 1}, {1, -1}} {
+		drawText(im, p.Add(d.Mul(scale)), s, scale, outline)
+	}
+	drawText(im, p, s, scale, fg)
+}
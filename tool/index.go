@@ -0,0 +1,508 @@
+package main
+
+// In-memory level index for the HTTP server
+//
+// The index holds a summary of every level in the server's directory,
+// along with inverted indexes from the words in level names and authors,
+// from tile types, and from authors to the levels which contain them.
+// It backs the index page, faceted search, the JSON API, and similar levels.
+//
+// Levels are indexed in two passes: first just the headers, so that names
+// show up quickly, then the whole level, spread over several goroutines.
+// refreshIndex only re-reads files whose size or modification time has changed,
+// and drops levels whose files have gone away. It runs at startup
+// and then every -poll interval (see watch.go). Levels are read through
+// the metadata database (see metadb.go), so unchanged levels aren't parsed
+// again after a restart.
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/juju/naturalsort"
+	"github.com/magical/cc3d"
+)
+
+type levelInfo struct {
+	ID            string
+	Name          string
+	Author        string
+	Width, Height int
+	Background    int
+	Modified      time.Time // from the gzip header, or the file's modification time
+
+	// The rest aren't set until the whole level has been read
+	Complete    bool
+	Types       map[int]bool // tile types in the level
+	Converts    bool         // converts to a C2M file without errors
+	Warnings    int          // number of Check warnings
+	Fingerprint *cc3d.Fingerprint
+}
+
+type idSet map[string]bool
+
+// The size and modification time of a level file when it was indexed,
+// for noticing when it changes.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statStamp(fi os.FileInfo) fileStamp {
+	return fileStamp{fi.ModTime(), fi.Size()}
+}
+
+func (a fileStamp) equal(b fileStamp) bool {
+	return a.modTime.Equal(b.modTime) && a.size == b.size
+}
+
+type levelIndex struct {
+	mu      sync.RWMutex
+	levels  map[string]levelInfo
+	words   map[string]idSet // lower-case words in names and authors
+	types   map[int]idSet
+	authors map[string]idSet     // by normalized author name
+	stamps  map[string]fileStamp // every file that has been read, even if it couldn't be parsed
+	version uint64               // incremented whenever a level is stored or removed
+}
+
+func newLevelIndex() *levelIndex {
+	return &levelIndex{
+		levels:  make(map[string]levelInfo),
+		words:   make(map[string]idSet),
+		types:   make(map[int]idSet),
+		authors: make(map[string]idSet),
+		stamps:  make(map[string]fileStamp),
+	}
+}
+
+// Look up a level by id.
+func (x *levelIndex) get(id string) (levelInfo, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	li, ok := x.levels[id]
+	return li, ok
+}
+
+// Returns every indexed level, in no particular order.
+func (x *levelIndex) all() []levelInfo {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	list := make([]levelInfo, 0, len(x.levels))
+	for _, li := range x.levels {
+		list = append(list, li)
+	}
+	return list
+}
+
+// Add or replace a level.
+func (x *levelIndex) store(li levelInfo) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.removeLocked(li.ID)
+	x.levels[li.ID] = li
+	x.version++
+	for _, w := range indexWords(li.Name + " " + li.Author) {
+		if x.words[w] == nil {
+			x.words[w] = make(idSet)
+		}
+		x.words[w][li.ID] = true
+	}
+	for t := range li.Types {
+		if x.types[t] == nil {
+			x.types[t] = make(idSet)
+		}
+		x.types[t][li.ID] = true
+	}
+	a := normalizeAuthor(li.Author)
+	if x.authors[a] == nil {
+		x.authors[a] = make(idSet)
+	}
+	x.authors[a][li.ID] = true
+}
+
+// Remove a level.
+func (x *levelIndex) remove(id string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.removeLocked(id)
+	delete(x.stamps, id)
+	x.version++
+}
+
+// Remove a level which can no longer be read,
+// keeping its stamp so that it isn't read again until the file changes.
+func (x *levelIndex) unlist(id string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.removeLocked(id)
+	x.version++
+}
+
+// Returns a number which changes whenever the index does.
+func (x *levelIndex) generation() uint64 {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.version
+}
+
+// Returns the ids of all levels which have been indexed or have failed to index.
+func (x *levelIndex) ids() []string {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	var ids []string
+	for id := range x.stamps {
+		ids = append(ids, id)
+	}
+	for id := range x.levels {
+		if _, ok := x.stamps[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (x *levelIndex) stamp(id string) (fileStamp, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	st, ok := x.stamps[id]
+	return st, ok
+}
+
+func (x *levelIndex) setStamp(id string, st fileStamp) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.stamps[id] = st
+}
+
+func (x *levelIndex) removeLocked(id string) {
+	old, ok := x.levels[id]
+	if !ok {
+		return
+	}
+	delete(x.levels, id)
+	for _, w := range indexWords(old.Name + " " + old.Author) {
+		delete(x.words[w], id)
+		if len(x.words[w]) == 0 {
+			delete(x.words, w)
+		}
+	}
+	for t := range old.Types {
+		delete(x.types[t], id)
+		if len(x.types[t]) == 0 {
+			delete(x.types, t)
+		}
+	}
+	a := normalizeAuthor(old.Author)
+	delete(x.authors[a], id)
+	if len(x.authors[a]) == 0 {
+		delete(x.authors, a)
+	}
+}
+
+// Split text into lower-case words for the index.
+func indexWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// Returns the ids of levels with a word in their name or author
+// starting with each of the words of text.
+// Returns nil if text has no words.
+func (x *levelIndex) matchText(text string) idSet {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	var result idSet
+	for _, q := range indexWords(text) {
+		found := make(idSet)
+		for w, ids := range x.words {
+			if strings.HasPrefix(w, q) {
+				for id := range ids {
+					if result == nil || result[id] {
+						found[id] = true
+					}
+				}
+			}
+		}
+		result = found
+	}
+	return result
+}
+
+// Returns the ids of levels which contain all the given tile types.
+func (x *levelIndex) matchTypes(types []int) idSet {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	var result idSet
+	for _, t := range types {
+		found := make(idSet)
+		for id := range x.types[t] {
+			if result == nil || result[id] {
+				found[id] = true
+			}
+		}
+		result = found
+	}
+	return result
+}
+
+// Bring the server's index up to date with its level directory.
+// Levels which have changed are also dropped from the render cache.
+func (s *server) refreshIndex() {
+	files, _ := filepath.Glob(filepath.Join(s.levelDir, "*.xml.gz"))
+	naturalsort.Sort(files)
+	type change struct {
+		fullname string
+		stamp    fileStamp
+	}
+	seen := make(map[string]bool)
+	var changed []change
+	var added, modified, removed int
+	for _, fullname := range files {
+		id, _, _ := cut(filepath.Base(fullname), ".")
+		if !s.isID(id) {
+			continue
+		}
+		seen[id] = true
+		fi, err := os.Stat(fullname)
+		if err != nil {
+			continue
+		}
+		st := statStamp(fi)
+		if old, ok := s.index.stamp(id); ok {
+			if old.equal(st) {
+				continue
+			}
+			modified++
+			s.cache.forget(fullname)
+		} else {
+			added++
+		}
+		changed = append(changed, change{fullname, st})
+	}
+	for _, id := range s.index.ids() {
+		if !seen[id] {
+			s.index.remove(id)
+			if err := s.db.remove(id); err != nil {
+				log.Println("warning: cannot update metadata database:", err)
+			}
+			s.cache.forget(filepath.Join(s.levelDir, id+".xml.gz"))
+			removed++
+		}
+	}
+	s.status.beginScan(len(changed))
+
+	// Read just the headers of new levels first so that names show up quickly
+	for _, c := range changed {
+		id, _, _ := cut(filepath.Base(c.fullname), ".")
+		if _, ok := s.index.get(id); ok {
+			continue
+		}
+		if rec, ok := s.db.get(id); ok && rec.stamp().equal(c.stamp) {
+			continue
+		}
+		m, err := readLevelHeader(c.fullname)
+		if err != nil {
+			continue
+		}
+		s.index.store(levelInfo{
+			ID:         id,
+			Name:       m.Name,
+			Author:     m.Author,
+			Width:      m.Width,
+			Height:     m.Height,
+			Background: m.Background,
+			Modified:   c.stamp.modTime.UTC(),
+		})
+	}
+
+	work := make(chan change)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range work {
+				err := s.indexFile(c.fullname, c.stamp)
+				if err != nil {
+					log.Println(err)
+				}
+				s.status.fileDone(err)
+			}
+		}()
+	}
+	for _, c := range changed {
+		work <- c
+	}
+	close(work)
+	wg.Wait()
+	s.status.endScan(len(s.index.all()), added, modified, removed)
+}
+
+// Add a level to the index, reading it if the metadata database is out of date.
+// The file is only read again once its stamp changes, even if it can't be parsed.
+func (s *server) indexFile(fullname string, st fileStamp) error {
+	id, _, _ := cut(filepath.Base(fullname), ".")
+	s.index.setStamp(id, st)
+	rec, err := s.db.record(fullname, st)
+	if err != nil {
+		return err
+	}
+	if rec.Error != "" {
+		// Don't leave the old version (or the header read by refreshIndex) searchable
+		s.index.unlist(id)
+		return fmt.Errorf("%s: %s", fullname, rec.Error)
+	}
+	types := make(map[int]bool)
+	for t := range rec.Tiles {
+		types[t] = true
+	}
+	modified := rec.Saved
+	if modified.IsZero() {
+		modified = rec.ModTime.UTC()
+	}
+	s.index.store(levelInfo{
+		ID:          id,
+		Name:        rec.Name,
+		Author:      rec.Author,
+		Width:       rec.Width,
+		Height:      rec.Height,
+		Background:  rec.Background,
+		Modified:    modified,
+		Complete:    true,
+		Types:       types,
+		Converts:    rec.Converts,
+		Warnings:    len(rec.Warnings),
+		Fingerprint: rec.Fingerprint,
+	})
+	return nil
+}
+
+// Size facets, by the longer side of the level
+var sizeFacets = []struct {
+	name     string
+	min, max int
+}{
+	{"small", 0, 16},
+	{"medium", 17, 32},
+	{"large", 33, 1 << 30},
+}
+
+func sizeFacet(li levelInfo) string {
+	n := li.Width
+	if li.Height > n {
+		n = li.Height
+	}
+	for _, f := range sizeFacets {
+		if f.min <= n && n <= f.max {
+			return f.name
+		}
+	}
+	return ""
+}
+
+// A faceted search of the index.
+// Empty fields match everything.
+type indexQuery struct {
+	text     string // words in the name or author
+	size     string // small, medium, or large
+	tiles    []int  // tile types which must all be present
+	converts string // yes or no
+	warnings string // yes or no
+	sort     string // id, name, author, or size
+	desc     bool
+}
+
+// The levels matching a query, sorted,
+// along with the number of matching levels in each facet.
+type indexResult struct {
+	levels   []levelInfo
+	sizes    map[string]int
+	converts map[string]int
+	warnings map[string]int
+	types    map[int]int
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// Search the index.
+// Levels which are still being indexed only match queries on text and size.
+func (x *levelIndex) search(q indexQuery) indexResult {
+	var ids idSet
+	if strings.TrimSpace(q.text) != "" {
+		ids = x.matchText(q.text)
+	}
+	if len(q.tiles) > 0 {
+		tileIDs := x.matchTypes(q.tiles)
+		if ids == nil {
+			ids = tileIDs
+		} else {
+			for id := range ids {
+				if !tileIDs[id] {
+					delete(ids, id)
+				}
+			}
+		}
+	}
+	res := indexResult{
+		sizes:    make(map[string]int),
+		converts: make(map[string]int),
+		warnings: make(map[string]int),
+		types:    make(map[int]int),
+	}
+	for _, li := range x.all() {
+		if ids != nil && !ids[li.ID] {
+			continue
+		}
+		if q.size != "" && sizeFacet(li) != q.size {
+			continue
+		}
+		if q.converts != "" && (!li.Complete || yesNo(li.Converts) != q.converts) {
+			continue
+		}
+		if q.warnings != "" && (!li.Complete || yesNo(li.Warnings > 0) != q.warnings) {
+			continue
+		}
+		res.levels = append(res.levels, li)
+		res.sizes[sizeFacet(li)]++
+		if li.Complete {
+			res.converts[yesNo(li.Converts)]++
+			res.warnings[yesNo(li.Warnings > 0)]++
+		}
+		for t := range li.Types {
+			res.types[t]++
+		}
+	}
+	less := func(a, b levelInfo) bool { return idLess(a.ID, b.ID) }
+	switch q.sort {
+	case "name":
+		less = func(a, b levelInfo) bool { return strings.ToLower(a.Name) < strings.ToLower(b.Name) }
+	case "author":
+		less = func(a, b levelInfo) bool { return strings.ToLower(a.Author) < strings.ToLower(b.Author) }
+	case "size":
+		less = func(a, b levelInfo) bool { return a.Width*a.Height < b.Width*b.Height }
+	}
+	levels := res.levels
+	sort.SliceStable(levels, func(i, j int) bool { return idLess(levels[i].ID, levels[j].ID) })
+	sort.SliceStable(levels, func(i, j int) bool {
+		if q.desc {
+			return less(levels[j], levels[i])
+		}
+		return less(levels[i], levels[j])
+	})
+	return res
+}
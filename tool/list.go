@@ -49,7 +49,7 @@ func process(filename string) error {
 	}
 	m, err := cc3d.ReadLevel(f)
 	if err != nil {
-		return err
+		return fmt.Errorf("%s: %w", filename, err)
 	}
 	levelid, _, _ := cut(filepath.Base(filename), ".")
 	cc3d.PrintInfo(m, levelid)
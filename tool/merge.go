@@ -0,0 +1,116 @@
+package main
+
+// Git integration.
+//
+// To use the merge and diff drivers, add this to .gitattributes:
+//
+//    *.xml.gz merge=cc3d diff=cc3d
+//    *.xml merge=cc3d diff=cc3d
+//
+// and this to .git/config:
+//
+//    [merge "cc3d"]
+//        name = CC3D level merge
+//        driver = tool -merge %O %A %B
+//    [diff "cc3d"]
+//        textconv = tool -text
+
+import (
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"io"
+	"log"
+	"os"
+
+	"github.com/magical/cc3d"
+)
+
+// Merge two levels with a common ancestor.
+// The result is written to the -o file, or over ours if -o isn't given,
+// as git expects of a merge driver. It is compressed if ours is:
+// git passes temporary files, so the file names can't be relied on.
+// Exits with status 1 if there were conflicts.
+func mergeMain() {
+	if flag.NArg() != 3 {
+		log.Fatal("usage: -merge [-o out.xml.gz] base ours theirs")
+	}
+	var maps [3]*cc3d.Map
+	for i, filename := range flag.Args() {
+		m, err := readLevelFile(filename)
+		if err != nil {
+			log.Fatal(err)
+		}
+		maps[i] = m
+	}
+	compress, err := isGzipFile(flag.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	merged, conflicts := cc3d.Merge(maps[0], maps[1], maps[2])
+	outname := outputFlag
+	if outname == "" {
+		outname = flag.Arg(1)
+	}
+	if err := writeLevelFile(outname, merged, compress); err != nil {
+		log.Fatal(err)
+	}
+	for _, c := range conflicts {
+		log.Printf("%s: conflict: %s", flag.Arg(1), c)
+	}
+	if len(conflicts) > 0 {
+		os.Exit(1)
+	}
+}
+
+// Reports whether a file starts with the gzip magic number.
+func isGzipFile(filename string) (bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	magic := make([]byte, len(gzipMagic))
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	return bytes.Equal(magic[:n], gzipMagic), nil
+}
+
+// Write a level, optionally compressed with gzip.
+func writeLevelFile(filename string, m *cc3d.Map, compress bool) error {
+	out, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if compress {
+		zw := gzip.NewWriter(out)
+		if err := cc3d.WriteLevel(zw, m); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	} else {
+		if err := cc3d.WriteLevel(out, m); err != nil {
+			return err
+		}
+	}
+	return out.Close()
+}
+
+// Print the text representation of a level, for use as a git textconv filter.
+func textMain() {
+	if flag.NArg() != 1 {
+		log.Fatal("usage: -text file")
+	}
+	m, err := readLevelFile(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := cc3d.WriteText(os.Stdout, m); err != nil {
+		log.Fatal(err)
+	}
+}
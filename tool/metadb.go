@@ -0,0 +1,373 @@
+package main
+
+// Level metadata database
+//
+// Parsing every level in a large directory takes a while, so the results are
+// kept in a JSON-lines file for each level directory, in the -db directory
+// (by default under the user's cache directory, so that level directories
+// aren't written to). Each line is a levelRecord; when a level changes a new
+// record is appended, and the last record for a level wins. Deleted levels get
+// a record with "deleted": true. The file is rewritten without the superseded
+// records when too many of its lines are superseded.
+//
+// A record is reused as long as the level file's size and modification time
+// haven't changed. If they have but the file's hash is the same, the level
+// isn't parsed again either. Bump recordVersion when the way records are
+// computed changes, so that old records are recomputed.
+//
+// The HTTP server builds its index from the database,
+// and -search and -stats read from it too.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/juju/naturalsort"
+	"github.com/magical/cc3d"
+)
+
+var dbFlag = flag.String("db", defaultDBDir(), "directory to keep level metadata databases in (empty to not keep any)")
+
+func defaultDBDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "cc3d")
+}
+
+const recordVersion = 1
+
+type levelRecord struct {
+	Version int       `json:"v"`
+	ID      string    `json:"id"`
+	Hash    string    `json:"hash"` // SHA-256 of the .xml.gz file
+	ModTime time.Time `json:"mtime"`
+	Size    int64     `json:"size"`
+	Deleted bool      `json:"deleted,omitempty"`
+	Error   string    `json:"error,omitempty"` // the level couldn't be read
+	Saved   time.Time `json:"saved,omitempty"` // modification time from the gzip header
+
+	Name         string            `json:"name"`
+	Author       string            `json:"author"`
+	Width        int               `json:"width"`
+	Height       int               `json:"height"`
+	Background   int               `json:"background"`
+	Tiles        map[int]int       `json:"tiles,omitempty"` // number of tiles of each type
+	Warnings     []string          `json:"warnings,omitempty"`
+	Converts     bool              `json:"converts"`
+	ConvertError string            `json:"convert_error,omitempty"`
+	Fingerprint  *cc3d.Fingerprint `json:"fingerprint,omitempty"`
+}
+
+func (r *levelRecord) stamp() fileStamp {
+	return fileStamp{r.ModTime, r.Size}
+}
+
+// Summarize a level file's contents.
+// Errors reading the level are recorded in the record rather than returned.
+func recordFromBytes(id string, b []byte, st fileStamp) levelRecord {
+	rec := levelRecord{
+		Version: recordVersion,
+		ID:      id,
+		Hash:    hashBytes(b),
+		ModTime: st.modTime,
+		Size:    st.size,
+	}
+	if zr, err := gzip.NewReader(bytes.NewReader(b)); err == nil {
+		rec.Saved = zr.Header.ModTime.UTC()
+	}
+	m, err := cc3d.ReadLevel(bytes.NewReader(b))
+	if err != nil {
+		rec.Error = err.Error()
+		return rec
+	}
+	rec.Name = m.Name
+	rec.Author = m.Author
+	rec.Width = m.Width
+	rec.Height = m.Height
+	rec.Background = m.Background
+	rec.Tiles = make(map[int]int)
+	for _, l := range m.Layers() {
+		for _, t := range l.Tiles {
+			rec.Tiles[t.Type]++
+		}
+	}
+	rec.Warnings = cc3d.Check(m)
+	if _, err := encodeLevel(m); err != nil {
+		rec.ConvertError = err.Error()
+	} else {
+		rec.Converts = true
+	}
+	rec.Fingerprint = m.Fingerprint()
+	return rec
+}
+
+func hashBytes(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// A metaDB is a level metadata database.
+// A nil *metaDB is an empty database which doesn't store anything.
+type metaDB struct {
+	mu       sync.Mutex
+	filename string
+	f        *os.File // opened for appending
+	records  map[string]levelRecord
+	lines    int
+}
+
+// Open the metadata database for a level directory, creating it if necessary.
+// The database is named after the directory and a hash of its absolute path.
+// Returns nil if -db is empty or the database can't be opened.
+func openDirDB(dir string) *metaDB {
+	if *dbFlag == "" {
+		return nil
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		log.Println("warning: not using metadata database:", err)
+		return nil
+	}
+	if err := os.MkdirAll(*dbFlag, 0777); err != nil {
+		log.Println("warning: not using metadata database:", err)
+		return nil
+	}
+	name := filepath.Base(abs) + "-" + hashBytes([]byte(abs))[:16] + ".jsonl"
+	db, err := openMetaDB(filepath.Join(*dbFlag, name))
+	if err != nil {
+		log.Println("warning: not using metadata database:", err)
+		return nil
+	}
+	return db
+}
+
+func openMetaDB(filename string) (*metaDB, error) {
+	db := &metaDB{
+		filename: filename,
+		records:  make(map[string]levelRecord),
+	}
+	if f, err := os.Open(filename); err == nil {
+		sc := bufio.NewScanner(f)
+		sc.Buffer(nil, 1<<20)
+		for sc.Scan() {
+			var rec levelRecord
+			if err := json.Unmarshal(sc.Bytes(), &rec); err != nil || rec.ID == "" {
+				// probably a partially written line; ignore it
+				continue
+			}
+			db.lines++
+			if rec.Deleted {
+				delete(db.records, rec.ID)
+			} else {
+				db.records[rec.ID] = rec
+			}
+		}
+		err := sc.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if db.needsCompacting() {
+		if err := db.compact(); err != nil {
+			return nil, err
+		}
+	} else {
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+		if err != nil {
+			return nil, err
+		}
+		db.f = f
+	}
+	return db, nil
+}
+
+// Reports whether most of the lines in the file are superseded records.
+func (db *metaDB) needsCompacting() bool {
+	return db.lines > 2*len(db.records)+100
+}
+
+// Rewrite the database file with just the current records,
+// and reopen it for appending.
+func (db *metaDB) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(db.filename), filepath.Base(db.filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(bw)
+	for _, rec := range db.records {
+		if err = enc.Encode(rec); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), db.filename)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	f, err := os.OpenFile(db.filename, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	if db.f != nil {
+		db.f.Close()
+	}
+	db.f = f
+	db.lines = len(db.records)
+	return nil
+}
+
+func (db *metaDB) get(id string) (levelRecord, bool) {
+	if db == nil {
+		return levelRecord{}, false
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	rec, ok := db.records[id]
+	return rec, ok
+}
+
+// Add or replace a record.
+func (db *metaDB) put(rec levelRecord) error {
+	if db == nil {
+		return nil
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if rec.Deleted {
+		delete(db.records, rec.ID)
+	} else {
+		db.records[rec.ID] = rec
+	}
+	db.lines++
+	if _, err := db.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if db.needsCompacting() {
+		return db.compact()
+	}
+	return nil
+}
+
+// Remove a level's record.
+func (db *metaDB) remove(id string) error {
+	if _, ok := db.get(id); !ok {
+		return nil
+	}
+	return db.put(levelRecord{ID: id, Deleted: true})
+}
+
+func (db *metaDB) Close() error {
+	if db == nil {
+		return nil
+	}
+	return db.f.Close()
+}
+
+// Returns an up to date record for a level file, from the database if possible.
+// New records are saved in the database.
+func (db *metaDB) record(fullname string, st fileStamp) (levelRecord, error) {
+	id, _, _ := cut(filepath.Base(fullname), ".")
+	old, ok := db.get(id)
+	ok = ok && old.Version == recordVersion
+	if ok && old.stamp().equal(st) {
+		return old, nil
+	}
+	b, err := os.ReadFile(fullname)
+	if err != nil {
+		return levelRecord{}, err
+	}
+	var rec levelRecord
+	if ok && old.Hash == hashBytes(b) {
+		// just touched
+		rec = old
+		rec.ModTime, rec.Size = st.modTime, st.size
+	} else {
+		rec = recordFromBytes(id, b, st)
+	}
+	if err := db.put(rec); err != nil {
+		log.Println("warning: cannot update metadata database:", err)
+	}
+	return rec, nil
+}
+
+// Expand a list of files and directories into a list of level files.
+// Directories are searched for .xml.gz files.
+func levelFiles(paths []string) []string {
+	var files []string
+	for _, p := range paths {
+		if fi, err := os.Stat(p); err == nil && !fi.IsDir() {
+			files = append(files, p)
+			continue
+		}
+		matches, _ := filepath.Glob(filepath.Join(p, "*.xml.gz"))
+		naturalsort.Sort(matches)
+		files = append(files, matches...)
+	}
+	return files
+}
+
+// Returns records for the given level files,
+// updating the database in each file's directory as needed.
+// Levels which can't be read are logged and skipped.
+func readRecords(files []string) []levelRecord {
+	dbs := make(map[string]*metaDB)
+	defer func() {
+		for _, db := range dbs {
+			db.Close()
+		}
+	}()
+	var records []levelRecord
+	for _, filename := range files {
+		dir := filepath.Dir(filename)
+		db, ok := dbs[dir]
+		if !ok {
+			db = openDirDB(dir)
+			dbs[dir] = db
+		}
+		fi, err := os.Stat(filename)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		rec, err := db.record(filename, statStamp(fi))
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if rec.Error != "" {
+			log.Printf("%s: %s", filename, rec.Error)
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records
+}
@@ -0,0 +1,105 @@
+package main
+
+// Routing for the level server
+//
+// Patterns are paths relative to a collection's mount point, with no leading slash.
+// A segment like {id} matches a path parameter, and may be followed by
+// a literal suffix, as in {id}_thumb.png. A final segment like {name...}
+// matches the rest of the path. Routes are tried in the order they were added,
+// and the first one which matches wins, so fixed paths should come first.
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+type routeParams map[string]string
+
+type routeHandler func(w http.ResponseWriter, req *http.Request, p routeParams)
+
+type route struct {
+	method   string
+	segments []string
+	handler  routeHandler
+}
+
+type router struct {
+	routes []route
+
+	// Reports whether a parameter value is acceptable, e.g. that an id is valid.
+	// A route with an unacceptable parameter doesn't match.
+	valid func(name, value string) bool
+}
+
+func (r *router) handle(method, pattern string, h routeHandler) {
+	r.routes = append(r.routes, route{method, strings.Split(pattern, "/"), h})
+}
+
+// Serve the request for path p, which is relative to the mount point.
+func (r *router) serve(w http.ResponseWriter, req *http.Request, p string) {
+	parts := strings.Split(p, "/")
+	var allowed []string
+	for _, rt := range r.routes {
+		params, ok := r.match(rt.segments, parts)
+		if !ok {
+			continue
+		}
+		if rt.method != req.Method {
+			allowed = append(allowed, rt.method)
+			continue
+		}
+		rt.handler(w, req, params)
+		return
+	}
+	if len(allowed) > 0 {
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	http.NotFound(w, req)
+}
+
+// Panics if a route starts with a fixed segment which could be a level id,
+// such as a directory missing from reservedNames, since it would hide that level.
+func (r *router) checkPrefixes(isID func(string) bool) {
+	for _, rt := range r.routes {
+		if seg := rt.segments[0]; !strings.HasPrefix(seg, "{") && isID(seg) {
+			panic("route " + strings.Join(rt.segments, "/") + " conflicts with level id " + seg)
+		}
+	}
+}
+
+func (r *router) match(segments, parts []string) (routeParams, bool) {
+	params := make(routeParams)
+	for i, seg := range segments {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "...}") {
+			name := seg[1 : len(seg)-len("...}")]
+			rest := strings.Join(parts[i:], "/")
+			if rest == "" || !r.valid(name, rest) {
+				return nil, false
+			}
+			params[name] = rest
+			return params, true
+		}
+		if i >= len(parts) {
+			return nil, false
+		}
+		if strings.HasPrefix(seg, "{") {
+			name, suffix, _ := cut(seg[1:], "}")
+			v := parts[i]
+			if !strings.HasSuffix(v, suffix) {
+				return nil, false
+			}
+			v = v[:len(v)-len(suffix)]
+			if v == "" || !r.valid(name, v) {
+				return nil, false
+			}
+			params[name] = v
+		} else if seg != parts[i] {
+			return nil, false
+		}
+	}
+	return params, len(segments) == len(parts)
+}
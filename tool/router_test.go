@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+// Every fixed path the server handles has to be reserved,
+// or it would hide a level with the same name.
+func TestRoutesReserved(t *testing.T) {
+	s := new(server)
+	s.addRoutes() // panics if a route isn't reserved
+
+	var r router
+	r.handle("GET", "api/levels", nil)
+	r.handle("GET", "extra/{file...}", nil)
+	defer func() {
+		if recover() == nil {
+			t.Error("checkPrefixes didn't notice that extra isn't reserved")
+		}
+	}()
+	r.checkPrefixes(isLevelName)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"github.com/magical/cc3d"
+)
+
+func searchMain(query string) {
+	q, err := cc3d.ParseQuery(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !q.NeedsTiles() {
+		// The metadata database has everything we need
+		for _, rec := range readRecords(levelFiles(flag.Args())) {
+			m := &cc3d.Map{
+				Name:       rec.Name,
+				Author:     rec.Author,
+				Width:      rec.Width,
+				Height:     rec.Height,
+				Background: rec.Background,
+			}
+			if _, ok := q.Match(m); ok {
+				fmt.Printf("%s: %s by %s\n", rec.ID, def(m.Name, "Untitled"), def(m.Author, "Author Unknown"))
+			}
+		}
+		return
+	}
+	for _, filename := range levelFiles(flag.Args()) {
+		err := searchFile(q, filename)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func searchFile(q *cc3d.Query, filename string) error {
+	m, err := readLevelFile(filename)
+	if err != nil {
+		return err
+	}
+	matches, ok := q.Match(m)
+	if !ok {
+		return nil
+	}
+	levelid, _, _ := cut(filepath.Base(filename), ".")
+	fmt.Printf("%s: %s by %s\n", levelid, def(m.Name, "Untitled"), def(m.Author, "Author Unknown"))
+	for _, match := range matches {
+		fmt.Printf("%s: %d,%d %s %d %s\n", levelid, match.X, match.Y, match.Layer, match.Tile.Type, match.Tile.Attributes.Name)
+	}
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -20,8 +21,9 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -30,167 +32,623 @@ import (
 	"github.com/juju/naturalsort"
 	"github.com/magical/cc3d"
 	"github.com/magical/cc3d/c2m"
-	"github.com/nfnt/resize"
 )
 
 var portFlag = flag.String("port", ":8080", "port (and host) to listen for HTTP connections on")
 
 func httpMain() {
-	dirs := flag.Args()
-	if len(dirs) == 0 {
-		dirs = []string{"cc3d_levels"}
+	config, err := loadServerConfig(*configFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	collections := config.Collections
+	if len(collections) == 0 {
+		dirs := flag.Args()
+		if len(dirs) == 0 {
+			dirs = []string{"cc3d_levels"}
+		}
+		collections = defaultCollections(dirs)
+	} else if flag.NArg() > 0 {
+		log.Fatal("cannot give level directories on the command line when the -config file lists collections")
+	}
+	// Load the default size now so that errors in the tileset show up immediately
+	tilesets := newTilesetCache(loadTiles, maxTilesets)
+	tilesets.get(defaultTileSize)
+	c2mTilesets := newTilesetCache(loadC2MTiles, maxTilesets)
+	c2mTilesets.get(defaultTileSize)
+	templates, err := loadTemplates(*templatesFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cache, err := newRenderCache(int64(*cacheSizeFlag)<<20, *cacheDirFlag, int64(*cacheDirSizeFlag)<<20)
+	if err != nil {
+		log.Fatal(err)
+	}
+	searchCache, err := newRenderCache(searchCacheSize, "", 0)
+	if err != nil {
+		log.Fatal(err)
 	}
 	var mux http.ServeMux
-	var h http.Handler = &mux
-	tileset := loadTiles(tileSize)
-	for i, levelDir := range dirs {
-		if _, err := os.Stat(levelDir); err != nil {
+	var servers []*server
+	for _, c := range collections {
+		if _, err := os.Stat(c.Path); err != nil {
 			log.Println("warning: cannot access level dir:", err)
 		}
 		s := &server{
-			tileset:  tileset,
-			title:    "CC3D",
-			levelDir: levelDir,
-		}
-		dirname := filepath.Base(levelDir)
-		if strings.Contains(dirname, "ben10") {
-			s.title = "Ben 10"
-		}
-		if strings.Contains(dirname, "cc3d") {
-			s.externalLinks = true
-		}
-		go s.buildIndex()
-		if i == 0 {
-			mux.Handle("/", s)
-		} else {
-			mux.Handle("/"+dirname+"/", s)
-		}
-		if len(dirs) == 1 {
-			h = s
+			tilesets:    tilesets,
+			c2mTilesets: c2mTilesets,
+			cache:       cache,
+			searchCache: searchCache,
+			templates:   templates,
+			index:       newLevelIndex(),
+			db:          openDirDB(c.Path),
+			uploadToken: config.UploadToken,
+			baseURL:     config.BaseURL,
+			levelDir:    c.Path,
+			mount:       c.Mount,
+			title:       c.Title,
+			idScheme:    c.IDs,
+			links:       c.Links,
+			breakpoints: c.Breakpoints,
+			breakEvery:  c.BreakEvery,
 		}
+		s.addRoutes()
+		go s.watch(*pollFlag)
+		mux.Handle(c.Mount, s)
+		servers = append(servers, s)
+	}
+	var h http.Handler = &mux
+	if len(servers) == 1 && servers[0].mount == "/" {
+		h = servers[0]
+	} else if !hasRootCollection(servers) {
+		mux.Handle("/", &collectionList{servers, templates})
 	}
 	log.Fatal(http.ListenAndServe(*portFlag, h))
 }
 
+func hasRootCollection(servers []*server) bool {
+	for _, s := range servers {
+		if s.mount == "/" {
+			return true
+		}
+	}
+	return false
+}
+
+// A level collection, served under its mount point.
 type server struct {
-	tileset       Tileset
-	levelDir      string
-	title         string
-	externalLinks bool
-	index         sync.Map
+	tilesets    *tilesetCache
+	c2mTilesets *tilesetCache
+	levelDir    string
+	mount       string // absolute path ending in a slash
+	title       string
+	idScheme    string // numericIDs or nameIDs
+	links       []linkConfig
+	breakpoints []int
+	breakEvery  int
+	routes      router
+	templates   pageTemplates
+	cache       *renderCache
+	searchCache *renderCache // search results, kept apart so they don't evict images
+	index       *levelIndex
+	db          *metaDB
+	status      indexStatus
+	uploadToken string
+	baseURL     string     // from the config; may be empty
+	uploadMu    sync.Mutex // held while choosing an id for an upload
 }
 
 func (s *server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if req.Method != "GET" {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-	_, base := path.Split(req.URL.Path)
-	if base == "" {
-		s.serveIndex(w, req)
-	} else if strings.HasSuffix(base, "_thumb.png") {
-		idStr := strings.TrimSuffix(base, "_thumb.png")
-		if s.isID(idStr) {
-			s.serveMap(w, req, idStr, true)
-		} else {
-			http.NotFound(w, req)
-		}
-	} else if strings.HasSuffix(base, ".png") {
-		idStr := strings.TrimSuffix(base, ".png")
-		if s.isID(idStr) {
-			s.serveMap(w, req, idStr, false)
-		} else {
-			http.NotFound(w, req)
-		}
-	} else if strings.HasSuffix(base, ".xml") {
-		idStr := strings.TrimSuffix(base, ".xml")
-		if s.isID(idStr) {
-			s.serveXML(w, req, idStr)
-		} else {
-			http.NotFound(w, req)
-		}
-	} else if !strings.Contains(base, ".") {
-		if s.isID(base) {
-			s.serveInfo(w, req, base)
-		} else {
-			http.NotFound(w, req)
-		}
-	} else {
+	if !strings.HasPrefix(req.URL.Path, s.mount) {
 		http.NotFound(w, req)
+		return
 	}
+	s.routes.serve(w, req, strings.TrimPrefix(req.URL.Path, s.mount))
 }
 
-type levelInfo struct {
-	Name   string
-	Author string
+func (s *server) addRoutes() {
+	r := &s.routes
+	r.valid = s.validParam
+	get := func(pattern string, h routeHandler) {
+		r.handle("GET", pattern, h)
+	}
+	page := func(h func(http.ResponseWriter, *http.Request)) routeHandler {
+		return func(w http.ResponseWriter, req *http.Request, _ routeParams) { h(w, req) }
+	}
+	level := func(h func(http.ResponseWriter, *http.Request, string)) routeHandler {
+		return func(w http.ResponseWriter, req *http.Request, p routeParams) { h(w, req, p["id"]) }
+	}
+
+	get("", page(s.serveIndex))
+	get("api/levels", page(s.serveAPILevels))
+	get("api/levels/{id}", level(s.serveAPILevel))
+	get("api/levels/{id}/conversion", level(s.serveAPIConversion))
+	get("api/levels/{id}/tiles", level(s.serveAPITiles))
+	get("api/{path...}", page(serveAPINotFound))
+	get("author", func(w http.ResponseWriter, req *http.Request, _ routeParams) {
+		http.Redirect(w, req, "author/", http.StatusMovedPermanently)
+	})
+	get("author/", page(s.serveAuthors))
+	get("author/{author...}", func(w http.ResponseWriter, req *http.Request, p routeParams) {
+		s.serveAuthor(w, req, p["author"])
+	})
+	get("diff/{a}/{b}.png", func(w http.ResponseWriter, req *http.Request, p routeParams) {
+		s.serveDiff(w, req, p["a"], p["b"], true)
+	})
+	get("diff/{a}/{b}", func(w http.ResponseWriter, req *http.Request, p routeParams) {
+		s.serveDiff(w, req, p["a"], p["b"], false)
+	})
+	get("view/{id}", level(s.serveViewer))
+	get("tile/{tile}.png", func(w http.ResponseWriter, req *http.Request, p routeParams) {
+		s.serveTileImage(w, req, p["tile"])
+	})
+	get("pack.zip", page(s.servePack))
+	get("feed.atom", page(s.serveFeed))
+	get("status", page(s.serveStatus))
+	get("static/{file...}", func(w http.ResponseWriter, req *http.Request, p routeParams) {
+		serveStatic(w, req, p["file"])
+	})
+	get("upload", page(s.serveUpload))
+	r.handle("POST", "upload", page(s.serveUpload))
+
+	get("{id}_thumb.png", level(func(w http.ResponseWriter, req *http.Request, id string) {
+		s.serveMap(w, req, id, true)
+	}))
+	get("{id}_c2m.png", level(s.serveC2MMap))
+	get("{id}.png", level(func(w http.ResponseWriter, req *http.Request, id string) {
+		s.serveMap(w, req, id, false)
+	}))
+	get("{id}.gif", level(s.serveAnimation))
+	get("{id}.svg", level(s.serveSVG))
+	get("{id}.c2m", level(s.serveC2M))
+	get("{id}.xml", level(s.serveXML))
+	get("{id}", level(s.serveInfo))
+	r.checkPrefixes(isLevelName)
 }
 
-func (s *server) buildIndex() {
-	files, _ := filepath.Glob(filepath.Join(s.levelDir, "*.xml.gz"))
-	naturalsort.Sort(files)
-	for _, fullname := range files {
-		fullname := fullname
-		func() {
-			f, err := os.Open(fullname)
-			if err != nil {
-				return
-			}
-			defer f.Close()
-			m, err := cc3d.ReadLevel(f)
-			if err != nil {
-				return
-			}
-			id, _, _ := cut(filepath.Base(fullname), ".")
-			s.index.Store(id, levelInfo{m.Name, m.Author})
-		}()
+// Route parameters which name levels must be valid ids.
+func (s *server) validParam(name, value string) bool {
+	switch name {
+	case "id", "a", "b":
+		return s.isID(value)
 	}
+	return true
 }
 
 // Reports whether idStr looks like a valid levelid.
 // Might not actually be valid.
 func (s *server) isID(idStr string) bool {
+	if s.idScheme == nameIDs {
+		return isLevelName(idStr)
+	}
 	if _, err := strconv.ParseInt(idStr, 10, 64); err == nil {
 		return true
 	}
 	return false
 }
 
+var levelNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Reports whether name can be the id of a level in a collection with named ids.
+func isLevelName(name string) bool {
+	return levelNameRegexp.MatchString(name) && !reservedNames[name]
+}
+
+// Names which can't be level ids because they're used by the server.
+var reservedNames = map[string]bool{
+	"api":    true,
+	"author": true,
+	"diff":   true,
+	"static": true,
+	"status": true,
+	"tile":   true,
+	"upload": true,
+	"view":   true,
+}
+
+// Reports whether a level starts a new group of links on the index page.
+// Numeric ids are grouped by the collection's breakpoints,
+// and other ids by their first letter.
+func (s *server) startsGroup(id, prev string) bool {
+	if n, err := strconv.Atoi(id); err == nil {
+		if s.breakEvery > 0 && n%s.breakEvery == 0 {
+			return true
+		}
+		for _, b := range s.breakpoints {
+			if n == b {
+				return true
+			}
+		}
+		return false
+	}
+	return prev != "" && !strings.EqualFold(id[:1], prev[:1])
+}
+
+// The landing page for a server with several collections.
+type collectionList struct {
+	servers   []*server
+	templates pageTemplates
+}
+
+type collectionsPage struct {
+	pageData
+	Collections []collectionEntry
+}
+
+type collectionEntry struct {
+	Mount, Title string
+	Levels       int
+}
+
+func (list *collectionList) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if name := strings.TrimPrefix(req.URL.Path, "/static/"); name != req.URL.Path {
+		serveStatic(w, req, name)
+		return
+	}
+	if req.URL.Path != "/" {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	page := collectionsPage{pageData: pageData{Site: "Level collections"}}
+	for _, s := range list.servers {
+		page.Collections = append(page.Collections, collectionEntry{s.mount, s.title, s.status.progress().Levels})
+	}
+	list.templates.render(w, "collections", page)
+}
+
+// Reports whether level id a sorts before b.
+// Numeric ids are compared numerically.
+func idLess(a, b string) bool {
+	x, errx := strconv.Atoi(a)
+	y, erry := strconv.Atoi(b)
+	if errx == nil && erry == nil {
+		return x < y
+	}
+	return a < b
+}
+
 var escape = template.HTMLEscapeString
 
+const indexPageSize = 60
+
+type indexPage struct {
+	pageData
+	Query   string // text of a search query
+	Form    facetForm
+	Uploads bool // whether to link to the upload form
+
+	// One of these is set, depending on the kind of page
+	Search *searchResults
+	Facets *facetResults
+	Browse *browseResults
+}
+
+// A page of every level, in groups (see startsGroup).
+type browseResults struct {
+	Total      int
+	Groups     [][]levelEntry
+	Pagination pagination
+}
+
 func (s *server) serveIndex(w http.ResponseWriter, req *http.Request) {
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	writeln := func(msg string, v ...interface{}) error {
-		_, err := fmt.Fprintf(w, msg+"\n", v...)
-		return err
-	}
-	writeln("<!doctype html>")
-	writeln("<title>%s Level maps</title>", escape(s.title))
-	writeln("<body style=\"font-family: Comic Sans MS, Chalkboard\">")
-	writeln("<h1>%s Level maps</h1>", escape(s.title))
+	req.ParseForm()
+	page := indexPage{
+		pageData: s.pageData(req),
+		Query:    req.Form.Get("q"),
+		Form:     facetFormFor(req.Form),
+		Uploads:  s.uploadToken != "",
+	}
+	if page.Query != "" {
+		page.Search = s.search(page.Query, req.Form)
+	} else if isFacetSearch(req.Form) {
+		page.Facets = s.facetSearch(req.Form)
+	} else {
+		page.Browse = s.browse(req.Form)
+	}
+	s.templates.render(w, "index", page)
+}
+
+// List a page of the levels in the directory.
+// Levels which haven't been indexed yet are listed by id.
+func (s *server) browse(form url.Values) *browseResults {
 	files, _ := filepath.Glob(filepath.Join(s.levelDir, "*.xml.gz"))
 	naturalsort.Sort(files)
-	writeln("<p>")
+	var ids []string
 	for _, fullname := range files {
-		name := filepath.Base(fullname)
-		id, _, _ := cut(name, ".")
-		if n, err := strconv.Atoi(id); err == nil {
-			if n == 1004 || n == 16501 || n == 17001 || n%250 == 0 {
-				writeln("<p>")
-			}
-		}
+		id, _, _ := cut(filepath.Base(fullname), ".")
 		if s.isID(id) {
-			var err error
-			if v, ok := s.index.Load(id); ok {
-				li := v.(levelInfo)
-				err = writeln(`<a href="%[1]s" title="%[2]s by %[3]s">%[1]s</a>`, escape(id), escape(li.Name), escape(li.Author))
-			} else {
-				err = writeln(`<a href="%[1]s">%[1]s</a>`, escape(id))
+			ids = append(ids, id)
+		}
+	}
+	res := &browseResults{Total: len(ids)}
+	var start, end int
+	res.Pagination, start, end = paginate(form, len(ids), indexPageSize)
+	var group []levelEntry
+	prev := ""
+	for _, id := range ids[start:end] {
+		if s.startsGroup(id, prev) && len(group) > 0 {
+			res.Groups = append(res.Groups, group)
+			group = nil
+		}
+		prev = id
+		if li, ok := s.index.get(id); ok {
+			group = append(group, entryFor(li))
+		} else {
+			group = append(group, levelEntry{ID: id})
+		}
+	}
+	if len(group) > 0 {
+		res.Groups = append(res.Groups, group)
+	}
+	return res
+}
+
+// The levels matching a search query.
+type searchResults struct {
+	Error      string
+	Total      int
+	Truncated  bool // there were more than maxSearchResults matches
+	Levels     []searchMatch
+	Pagination pagination
+}
+
+type searchMatch struct {
+	levelEntry
+	Matches []string // the tiles which matched
+}
+
+const maxSearchResults = 1000
+
+// Size of the in-memory cache of tile search results, in bytes
+const searchCacheSize = 4 << 20
+
+// Find the levels matching a search query.
+func (s *server) search(query string, form url.Values) *searchResults {
+	res := new(searchResults)
+	q, err := cc3d.ParseQuery(query)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	levels := s.searchLevels(q, query)
+	if len(levels) > maxSearchResults {
+		levels = levels[:maxSearchResults]
+		res.Truncated = true
+	}
+	res.Total = len(levels)
+	var start, end int
+	res.Pagination, start, end = paginate(form, len(levels), searchPageSize)
+	res.Levels = levels[start:end]
+	return res
+}
+
+// Search the indexed levels, in id order.
+// Queries on just the name, author, size, and background are answered
+// from the index. Other queries have to read every level, so they stop
+// after one more than maxSearchResults matches, and the results are kept
+// in the render cache until the index changes.
+func (s *server) searchLevels(q *cc3d.Query, query string) []searchMatch {
+	candidates := s.index.all()
+	sort.Slice(candidates, func(i, j int) bool { return idLess(candidates[i].ID, candidates[j].ID) })
+	var levels []searchMatch
+	if !q.NeedsTiles() {
+		for _, li := range candidates {
+			m := &cc3d.Map{Name: li.Name, Author: li.Author, Width: li.Width, Height: li.Height, Background: li.Background}
+			if _, ok := q.Match(m); ok {
+				levels = append(levels, searchMatch{levelEntry: entryFor(li)})
 			}
-			if err != nil {
-				break
+		}
+		return levels
+	}
+
+	abs, _ := filepath.Abs(s.levelDir)
+	key := fmt.Sprintf("search\x00%s\x00%d\x00%s", abs, s.index.generation(), query)
+	if e, ok := s.searchCache.get(key); ok && json.Unmarshal(e.data, &levels) == nil {
+		return levels
+	}
+	for _, li := range candidates {
+		m, err := readLevelFile(filepath.Join(s.levelDir, li.ID+".xml.gz"))
+		if err != nil {
+			continue
+		}
+		matches, ok := q.Match(m)
+		if !ok {
+			continue
+		}
+		sm := searchMatch{levelEntry: entryFor(li)}
+		for _, match := range matches {
+			sm.Matches = append(sm.Matches, fmt.Sprintf("(%d,%d) %s: %s", match.X, match.Y, match.Layer, match.Tile.Attributes.Name))
+		}
+		levels = append(levels, sm)
+		if len(levels) > maxSearchResults {
+			break
+		}
+	}
+	if data, err := json.Marshal(levels); err == nil {
+		s.searchCache.add(&cacheEntry{key: key, data: data, modTime: time.Now()})
+	}
+	return levels
+}
+
+const searchPageSize = 100
+
+// Reports whether the form has any faceted search parameters.
+func isFacetSearch(form url.Values) bool {
+	for _, k := range []string{"text", "size", "tile", "converts", "warnings", "sort"} {
+		if form.Get(k) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func indexQueryFromForm(form url.Values) (indexQuery, error) {
+	q := indexQuery{
+		text:     form.Get("text"),
+		size:     form.Get("size"),
+		converts: form.Get("converts"),
+		warnings: form.Get("warnings"),
+		sort:     form.Get("sort"),
+		desc:     form.Get("desc") != "",
+	}
+	for _, v := range form["tile"] {
+		if v == "" {
+			continue
+		}
+		t, err := strconv.Atoi(v)
+		if err != nil {
+			return q, fmt.Errorf("invalid tile type %q", v)
+		}
+		q.tiles = append(q.tiles, t)
+	}
+	return q, nil
+}
+
+// The form for a faceted search.
+type facetForm struct {
+	Text    string
+	Selects []selectBox
+	Desc    bool
+}
+
+type selectBox struct {
+	Name    string
+	Options []selectOption
+}
+
+type selectOption struct {
+	Value, Label string
+	Selected     bool
+}
+
+func facetFormFor(form url.Values) facetForm {
+	box := func(name string, options ...string) selectBox {
+		b := selectBox{Name: name}
+		for i := 0; i < len(options); i += 2 {
+			b.Options = append(b.Options, selectOption{options[i], options[i+1], form.Get(name) == options[i]})
+		}
+		return b
+	}
+	tiles := []string{"", "Any tile"}
+	for _, t := range cc3d.TileTypes() {
+		tiles = append(tiles, strconv.Itoa(t), fmt.Sprintf("%s (%d)", cc3d.TileName(t), t))
+	}
+	return facetForm{
+		Text: form.Get("text"),
+		Selects: []selectBox{
+			box("size", "", "Any size", "small", "Small", "medium", "Medium", "large", "Large"),
+			box("tile", tiles...),
+			box("converts", "", "C2M: any", "yes", "Converts to C2M", "no", "Doesn't convert"),
+			box("warnings", "", "Warnings: any", "yes", "Has warnings", "no", "No warnings"),
+			box("sort", "id", "Sort by id", "name", "Sort by name", "author", "Sort by author", "size", "Sort by size"),
+		},
+		Desc: form.Get("desc") != "",
+	}
+}
+
+// The results of a faceted search of the index.
+type facetResults struct {
+	Error      string
+	Total      int
+	Facets     []facet
+	Tiles      []facetLink // in order of how many levels have the tile
+	Levels     []levelEntry
+	Pagination pagination
+}
+
+type facet struct {
+	Label string
+	Links []facetLink
+}
+
+// A link which narrows the search to one value of a facet.
+type facetLink struct {
+	Href  string
+	Value string
+	Count int
+}
+
+// Search the index.
+func (s *server) facetSearch(form url.Values) *facetResults {
+	res := new(facetResults)
+	q, err := indexQueryFromForm(form)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	r := s.index.search(q)
+	res.Total = len(r.levels)
+
+	addFacet := func(label, key string, values []string, counts map[string]int) {
+		f := facet{Label: label}
+		for _, v := range values {
+			if n := counts[v]; n > 0 {
+				f.Links = append(f.Links, facetLink{formLink(form, key, v), v, n})
 			}
 		}
+		if len(f.Links) > 0 {
+			res.Facets = append(res.Facets, f)
+		}
+	}
+	addFacet("Size", "size", []string{"small", "medium", "large"}, r.sizes)
+	addFacet("Converts to C2M", "converts", []string{"yes", "no"}, r.converts)
+	addFacet("Has warnings", "warnings", []string{"yes", "no"}, r.warnings)
+	types := make([]int, 0, len(r.types))
+	for t := range r.types {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		if r.types[types[i]] != r.types[types[j]] {
+			return r.types[types[i]] > r.types[types[j]]
+		}
+		return types[i] < types[j]
+	})
+	for _, t := range types {
+		res.Tiles = append(res.Tiles, facetLink{formLink(form, "tile", strconv.Itoa(t)), cc3d.TileName(t), r.types[t]})
+	}
+
+	var start, end int
+	res.Pagination, start, end = paginate(form, len(r.levels), searchPageSize)
+	for _, li := range r.levels[start:end] {
+		e := entryFor(li)
+		var notes []string
+		if li.Complete && !li.Converts {
+			notes = append(notes, "doesn't convert")
+		}
+		if li.Warnings > 0 {
+			notes = append(notes, fmt.Sprintf("%d warnings", li.Warnings))
+		}
+		e.Note = strings.Join(notes, ", ")
+		res.Levels = append(res.Levels, e)
 	}
+	return res
+}
+
+func readLevelFile(filename string) (*cc3d.Map, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, err := cc3d.ReadLevel(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return m, nil
+}
+
+func readLevelHeader(filename string) (*cc3d.Map, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return cc3d.ReadHeader(f)
 }
 
 type Map struct {
@@ -201,26 +659,33 @@ type Map struct {
 // Read the level with the given id.
 // Returns nil and prints an error if the level isn't found an error occurs during parsing.
 func (s *server) readLevel(w http.ResponseWriter, req *http.Request, id string) *Map {
+	m, err := s.loadLevel(id)
+	if err != nil {
+		writeError(w, err)
+		return nil
+	}
+	return m
+}
+
+// Read the level with the given id.
+// Returns an httpError if the level doesn't exist.
+func (s *server) loadLevel(id string) (*Map, error) {
 	filename := filepath.Join(s.levelDir, id+".xml.gz")
 	f, err := os.Open(filename)
 	if err != nil {
-		http.NotFound(w, req)
-		return nil
+		return nil, &httpError{http.StatusNotFound, errors.New("404 page not found")}
 	}
+	defer f.Close()
 	zr, err := gzip.NewReader(f)
 	if err != nil {
-		log.Println(err)
-		http.Error(w, err.Error(), 500)
-		return nil
+		return nil, err
 	}
 	mtime := zr.Header.ModTime.UTC()
 	m, err := cc3d.ReadLevel(zr)
 	if err != nil {
-		log.Println(err)
-		http.Error(w, err.Error(), 500)
-		return nil
+		return nil, err
 	}
-	return &Map{m, mtime}
+	return &Map{m, mtime}, nil
 }
 
 func (s *server) serveXML(w http.ResponseWriter, req *http.Request, id string) {
@@ -261,52 +726,132 @@ func acceptsGzip(req *http.Request) bool {
 	return false
 }
 
+type infoPage struct {
+	pageData
+	ID         string
+	Level      *Map
+	Title      string // "<name> by <author>"
+	URL        string // absolute URL of the page, for link previews
+	Image      string // absolute URL of the thumbnail
+	AuthorLink string
+	Links      []externalLink
+	Conversion conversionInfo
+	Inventory  []apiTileCount
+	Warnings   []apiWarning
+	Similar    []levelEntry
+	Prev, Next string // ids of the neighbouring levels
+}
+
+type externalLink struct {
+	Label, URL string
+}
+
+// Returns the absolute URL of a path relative to the mount point.
+// Falls back to http and the request's Host if no base_url is configured.
+func (s *server) absURL(req *http.Request, rel string) string {
+	base := s.baseURL
+	if base == "" {
+		base = "http://" + req.Host
+	}
+	return base + s.mount + rel
+}
+
 func (s *server) serveInfo(w http.ResponseWriter, req *http.Request, id string) {
 	m := s.readLevel(w, req, id)
 	if m == nil {
 		return
 	}
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	writeln := func(msg string, v ...interface{}) {
-		fmt.Fprintf(w, msg+"\n", v...)
-	}
-	u := *req.URL
-	u.Host = req.Host
-	u.Scheme = "http" // TODO https
-	pageTitle := fmt.Sprintf("%s by %s", def(m.Map.Name, "Untitled"), def(m.Map.Author, "Author Unknown"))
-	writeln("<!doctype html>")
-	writeln("<title>%s Levelid %s: %s</title>", escape(s.title), escape(id), escape(pageTitle))
-	writeln("<meta property=\"og:title\" content=\"%s: %s\" />", escape(id), escape(pageTitle))
-	writeln("<meta property=\"og:site_name\" content=\"%s levels\" />", escape(s.title))
-	writeln("<meta property=\"og:type\" content=\"website\" />")
-	writeln("<meta property=\"og:url\" content=\"%s\" />", escape(u.String()))
-	u.Path += "_thumb.png"
-	u.RawQuery = ""
-	writeln("<meta property=\"og:image\" content=\"%s\" />", escape(u.String()))
-
-	writeln("<body style=\"font-family: Comic Sans MS, Chalkboard\">")
-	writeln("<h1>%s</h1>", escape(pageTitle))
-	writeln("<p><img src=\"%s.png\">", escape(id))
-	if !m.ModTime.IsZero() {
-		writeln("<p>%s", m.ModTime.Format("Monday, January 02 2006 15:04:05 UTC"))
-	}
-	writeln("<p><a href=\"%s.xml\">Raw XML</a>", escape(id))
-	if s.externalLinks {
-		writeln("| <a rel=\"noreferrer\" href=\"https://s3.amazonaws.com/cc3d-editorreplays/hint_%s.hnt\">Replay</a>", escape(id))
-	}
-	l, err := toLexyURL(m)
-	if err == nil {
-		writeln("<p><a href=\"%s\">Play in Lexy's Labyrinth</a>", escape(l))
-	} else {
-		writeln("<p><strike title=\"%s\">Play in Lexy's Labyrinth</strike>", escape(err.Error()))
+	page := infoPage{
+		pageData:   s.pageData(req),
+		ID:         id,
+		Level:      m,
+		Title:      fmt.Sprintf("%s by %s", def(m.Map.Name, "Untitled"), def(m.Map.Author, "Author Unknown")),
+		URL:        s.absURL(req, id),
+		Conversion: s.conversion(id, m),
+		Inventory:  inventory(m.Map),
+		Warnings:   diagnose(m.Map),
+	}
+	page.Image = s.absURL(req, id+"_thumb.png")
+	if m.Author != "" {
+		page.AuthorLink = "author/" + authorLink(m.Author)
+	}
+	for _, l := range s.links {
+		if href, ok := l.expand(id); ok {
+			page.Links = append(page.Links, externalLink{l.Label, href})
+		}
+	}
+	for _, x := range s.similarLevels(id, m.Fingerprint()) {
+		e := entryFor(x.info)
+		e.Note = fmt.Sprintf("%.0f%%", x.similarity*100)
+		page.Similar = append(page.Similar, e)
+	}
+	page.Prev, page.Next = s.neighbours(id)
+	s.templates.render(w, "info", page)
+}
+
+type viewerPage struct {
+	pageData
+	ID    string
+	Title string
+	Level *Map
+}
+
+// Serve the interactive viewer (see static/viewer.js).
+func (s *server) serveViewer(w http.ResponseWriter, req *http.Request, id string) {
+	m := s.readLevel(w, req, id)
+	if m == nil {
+		return
+	}
+	s.templates.render(w, "viewer", viewerPage{
+		pageData: s.pageData(req),
+		ID:       id,
+		Title:    fmt.Sprintf("%s by %s", def(m.Map.Name, "Untitled"), def(m.Map.Author, "Author Unknown")),
+		Level:    m,
+	})
+}
+
+// Returns the ids of the levels before and after id, or empty strings if there aren't any.
+func (s *server) neighbours(id string) (prev, next string) {
+	for _, x := range s.index.ids() {
+		if idLess(x, id) && (prev == "" || idLess(prev, x)) {
+			prev = x
+		}
+		if idLess(id, x) && (next == "" || idLess(x, next)) {
+			next = x
+		}
+	}
+	return prev, next
+}
+
+type similarLevel struct {
+	id         string
+	info       levelInfo
+	similarity float64
+}
+
+const maxSimilarLevels = 10
+
+// Find the indexed levels most similar to the given fingerprint.
+func (s *server) similarLevels(id string, fp *cc3d.Fingerprint) []similarLevel {
+	var similar []similarLevel
+	for _, li := range s.index.all() {
+		if li.ID == id || li.Fingerprint == nil {
+			continue
+		}
+		if sim := cc3d.Similarity(fp, li.Fingerprint); sim >= *thresholdFlag {
+			similar = append(similar, similarLevel{li.ID, li, sim})
+		}
 	}
-	if s.externalLinks {
-		baseURL := "http://cc3d.chuckschallenge.com"
-		if n, err := strconv.Atoi(id); err == nil && n < 15000 {
-			baseURL = "http://beta.chuckschallenge.com"
+	sort.Slice(similar, func(i, j int) bool {
+		if similar[i].similarity != similar[j].similarity {
+			return similar[i].similarity > similar[j].similarity
 		}
-		writeln("<p><a rel=\"noreferrer\" href=\"%s/Share.php?levelId=%s\">View this level on chuckschallenge.com</a>", escape(baseURL), escape(id))
+		return idLess(similar[i].id, similar[j].id)
+	})
+	if len(similar) > maxSimilarLevels {
+		similar = similar[:maxSimilarLevels]
 	}
+	return similar
 }
 
 func def(s, defaultStr string) string {
@@ -317,39 +862,299 @@ func def(s, defaultStr string) string {
 }
 
 func (s *server) serveMap(w http.ResponseWriter, req *http.Request, id string, thumbnail bool) {
-	m := s.readLevel(w, req, id)
-	if m == nil {
+	opts, err := mapOptionsFromQuery(req.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	var im image.Image
-	im, err := makeMap(m.Map, s.tileset, false)
+	kind := "map"
+	if thumbnail {
+		kind = "thumb"
+	}
+	s.serveCached(w, req, kind, "image/png", []string{id}, func() ([]byte, time.Time, error) {
+		m, err := s.loadLevel(id)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		if thumbnail {
+			opts.Size = thumbnailSize(m.Map)
+		}
+		if err := checkImageArea(m.Width, m.Height, opts.Size); err != nil {
+			return nil, time.Time{}, err
+		}
+		im, err := makeMap(m.Map, s.tilesets.get(loadSize(opts.Size)), opts)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, im); err != nil {
+			return nil, time.Time{}, err
+		}
+		return buf.Bytes(), m.ModTime, nil
+	})
+}
+
+// Thumbnails are drawn with tiles small enough to fit in 200x200,
+// rather than drawing the full size map and shrinking it.
+func thumbnailSize(m *cc3d.Map) int {
+	n := m.Width
+	if m.Height > n {
+		n = m.Height
+	}
+	if n <= 0 {
+		return defaultTileSize
+	}
+	// Only a few sizes are used, so that only a few tilesets get loaded
+	for _, size := range thumbnailSizes {
+		if size*n <= 200 {
+			return size
+		}
+	}
+	return 1
+}
+
+var thumbnailSizes = []int{48, 32, 24, 16, 8, 4, 2, 1}
+
+// Tile sizes which can be requested with the size query parameter.
+// Keeping to a few sizes bounds the number of tilesets the server loads.
+var serverTileSizes = []int{16, 24, 32, 48, 64, 96}
+
+// Largest map image the server will draw, in pixels
+const maxImageArea = 4096 * 4096
+
+// Returns an error if a w×h level drawn with tiles of the given size
+// would be larger than maxImageArea.
+func checkImageArea(w, h, size int) error {
+	if w*h*size*size > maxImageArea {
+		return &httpError{http.StatusUnprocessableEntity, errors.New("level is too large to draw at this size")}
+	}
+	return nil
+}
+
+// Serve a map of the level as converted to C2M.
+func (s *server) serveC2MMap(w http.ResponseWriter, req *http.Request, id string) {
+	size, err := sizeFromQuery(req.URL.Query())
 	if err != nil {
-		log.Println(err)
-		http.Error(w, err.Error(), 500)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if thumbnail {
-		im = resize.Thumbnail(200, 200, im, resize.Bilinear)
+	s.serveCached(w, req, "c2m", "image/png", []string{id}, func() ([]byte, time.Time, error) {
+		m, err := s.loadLevel(id)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		c, err := convertLevel(m.Map)
+		if err != nil {
+			return nil, time.Time{}, &httpError{http.StatusUnprocessableEntity, err}
+		}
+		if err := checkImageArea(c.Width, c.Height, size); err != nil {
+			return nil, time.Time{}, err
+		}
+		tileset := s.c2mTilesets.get(loadSize(size))
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, scaleUp(makeC2MMap(c, tileset), tileset.TileSize(), size)); err != nil {
+			return nil, time.Time{}, err
+		}
+		return buf.Bytes(), m.ModTime, nil
+	})
+}
+
+// Serve a level map as an SVG image.
+// Sprites are embedded unless the sprites=link query parameter is given,
+// in which case they refer to /tile/.
+func (s *server) serveSVG(w http.ResponseWriter, req *http.Request, id string) {
+	link := req.URL.Query().Get("sprites") == "link"
+	opts, err := mapOptionsFromQuery(req.URL.Query())
+	if err == nil && (opts.Unexpected || opts.Grid || opts.Connections || opts.Diagnostics) {
+		err = errors.New("SVG maps can't be annotated; use PNG output instead")
 	}
-	err = png.Encode(w, im)
 	if err != nil {
-		log.Println(err)
-		// too late to change the response
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.serveCached(w, req, "svg", "image/svg+xml", []string{id}, func() ([]byte, time.Time, error) {
+		m, err := s.loadLevel(id)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		// Linked sprites come from /tile/, which serves the default size;
+		// the SVG's viewBox scales them to the requested size.
+		size := loadSize(opts.Size)
+		if link {
+			size = defaultTileSize
+		}
+		var buf bytes.Buffer
+		if err := writeSVG(&buf, m.Map, s.tilesets.get(size), opts, link); err != nil {
+			return nil, time.Time{}, err
+		}
+		return buf.Bytes(), m.ModTime, nil
+	})
+}
+
+// Serve an animated GIF of the player following the moves query parameter.
+func (s *server) serveAnimation(w http.ResponseWriter, req *http.Request, id string) {
+	moves := req.URL.Query().Get("moves")
+	if _, err := parseMoves(moves); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	size, err := sizeFromQuery(req.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.serveCached(w, req, "gif", "image/gif", []string{id}, func() ([]byte, time.Time, error) {
+		m, err := s.loadLevel(id)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		if m.Width*m.Height*size*size > maxAnimationArea {
+			return nil, time.Time{}, &httpError{http.StatusUnprocessableEntity, errors.New("level is too large to animate at this size")}
+		}
+		var buf bytes.Buffer
+		if err := writeAnimation(&buf, m.Map, s.tilesets.get(loadSize(size)), size, moves, 15); err != nil {
+			return nil, time.Time{}, err
+		}
+		return buf.Bytes(), m.ModTime, nil
+	})
 }
 
-func toLexyURL(m *Map) (url_ string, err error) {
-	defer func() {
-		if v := recover(); v != nil {
-			log.Println(err)
-			url_, err = "", errors.New("level conversion panicked")
+// Serve a single tile image, named <type>_<dir>,
+// or <type>_<dir>_arrow for the tile's direction arrow.
+func (s *server) serveTileImage(w http.ResponseWriter, req *http.Request, name string) {
+	arrow := strings.HasSuffix(name, "_arrow")
+	name = strings.TrimSuffix(name, "_arrow")
+	a, b, _ := cut(name, "_")
+	typ, errt := strconv.Atoi(a)
+	dir, errd := strconv.Atoi(b)
+	if errt != nil || errd != nil {
+		http.NotFound(w, req)
+		return
+	}
+	t := cc3d.Tile{Type: typ, Direction: dir}
+	tileset := s.tilesets.get(defaultTileSize)
+	var im image.Image
+	if arrow {
+		im = tileset.Direction(t)
+	} else {
+		im = tileset.TileImage(t)
+	}
+	if im == nil {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "max-age=86400")
+	png.Encode(w, im)
+}
+
+// Serve the differences between two levels,
+// either as an HTML page or as a PNG highlighting the changes.
+func (s *server) serveDiff(w http.ResponseWriter, req *http.Request, a, b string, image bool) {
+	if image {
+		size, err := sizeFromQuery(req.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.serveCached(w, req, "diff", "image/png", []string{a, b}, func() ([]byte, time.Time, error) {
+			ma, err := s.loadLevel(a)
+			if err != nil {
+				return nil, time.Time{}, err
+			}
+			mb, err := s.loadLevel(b)
+			if err != nil {
+				return nil, time.Time{}, err
+			}
+			w, h := ma.Width, ma.Height
+			if mb.Width > w {
+				w = mb.Width
+			}
+			if mb.Height > h {
+				h = mb.Height
+			}
+			if err := checkImageArea(w, h, size); err != nil {
+				return nil, time.Time{}, err
+			}
+			im, err := makeDiffMap(ma.Map, mb.Map, cc3d.DiffLevels(ma.Map, mb.Map), s.tilesets.get(loadSize(size)), size)
+			if err != nil {
+				return nil, time.Time{}, err
+			}
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, im); err != nil {
+				return nil, time.Time{}, err
+			}
+			modTime := ma.ModTime
+			if mb.ModTime.After(modTime) {
+				modTime = mb.ModTime
+			}
+			return buf.Bytes(), modTime, nil
+		})
+		return
+	}
+	ma := s.readLevel(w, req, a)
+	if ma == nil {
+		return
+	}
+	mb := s.readLevel(w, req, b)
+	if mb == nil {
+		return
+	}
+	page := diffPage{pageData: s.pageData(req), A: a, B: b}
+	d := cc3d.DiffLevels(ma.Map, mb.Map)
+	if !d.Empty() {
+		var buf bytes.Buffer
+		d.WriteTo(&buf)
+		page.Changes = buf.String()
+	}
+	s.templates.render(w, "diff", page)
+}
+
+type diffPage struct {
+	pageData
+	A, B    string
+	Changes string // empty if the levels are identical
+}
+
+// The result of converting a level to C2M, as shown on the info page.
+type conversionInfo struct {
+	Converted bool   `json:"converted"`          // the level converts, though it may not encode
+	LexyURL   string `json:"lexy_url,omitempty"` // empty if the level can't be encoded
+	Error     string `json:"error,omitempty"`
+}
+
+// Convert a level to C2M, or return the cached result of a previous conversion.
+// If m is nil, the level is read if necessary.
+func (s *server) conversion(id string, m *Map) conversionInfo {
+	var ci conversionInfo
+	key, err := s.cacheKey("conversion", nil, id)
+	if err == nil {
+		if e, ok := s.cache.get(key); ok && json.Unmarshal(e.data, &ci) == nil {
+			return ci
 		}
-	}()
-	c, err := cc3d.Convert(m.Map)
+	}
+	if m == nil {
+		if m, err = s.loadLevel(id); err != nil {
+			ci.Error = err.Error()
+			return ci
+		}
+	}
+	c, err := convertLevel(m.Map)
+	if err == nil {
+		ci.Converted = true
+		ci.LexyURL, err = toLexyURL(c)
+	}
 	if err != nil {
-		return "", err
+		ci.Error = err.Error()
+	}
+	if key != "" {
+		data, _ := json.Marshal(ci)
+		s.cache.put(key, data, m.ModTime)
 	}
+	return ci
+}
+
+func toLexyURL(c *c2m.Map) (url_ string, err error) {
 	b := new(bytes.Buffer)
 	err = c2m.Encode(b, c)
 	if err != nil {
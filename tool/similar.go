@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/juju/naturalsort"
+	"github.com/magical/cc3d"
+)
+
+var thresholdFlag = flag.Float64("threshold", 0.8, "minimum similarity for -similar")
+
+// Print clusters of similar levels in the given directories.
+func similarMain() {
+	dirs := flag.Args()
+	if len(dirs) == 0 {
+		dirs = []string{"."}
+	}
+	var files []string
+	for _, dir := range dirs {
+		if fi, err := os.Stat(dir); err == nil && !fi.IsDir() {
+			files = append(files, dir)
+			continue
+		}
+		matches, _ := filepath.Glob(filepath.Join(dir, "*.xml.gz"))
+		naturalsort.Sort(matches)
+		files = append(files, matches...)
+	}
+
+	var names []string
+	var fps []*cc3d.Fingerprint
+	for _, filename := range files {
+		m, err := readLevelFile(filename)
+		if err != nil {
+			log.Printf("%s: %v", filename, err)
+			continue
+		}
+		names = append(names, filename)
+		fps = append(fps, m.Fingerprint())
+	}
+
+	for i, cluster := range cc3d.Cluster(fps, *thresholdFlag) {
+		if i > 0 {
+			fmt.Println()
+		}
+		first := cluster[0]
+		for _, j := range cluster {
+			sim := cc3d.Similarity(fps[first], fps[j])
+			exact := ""
+			if fps[first].Hash == fps[j].Hash {
+				exact = " (exact)"
+			}
+			fmt.Printf("%.2f %s%s\n", sim, names[j], exact)
+		}
+	}
+}
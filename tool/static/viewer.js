@@ -0,0 +1,281 @@
+// Interactive level viewer: zoom, pan, layer toggles, and tile inspection.
+//
+// The page has a #viewer element whose data-svg and data-tiles attributes
+// give the URLs of the level's SVG map and of its tiles in the JSON API
+// (api/levels/<id>/tiles). The SVG is inlined into the page so that its
+// layer groups (<g id="layer-NAME">) can be hidden individually.
+"use strict";
+
+(function () {
+	const viewer = document.getElementById("viewer");
+	if (!viewer) {
+		return;
+	}
+	const viewport = viewer.querySelector(".viewer-viewport");
+	const canvas = viewer.querySelector(".viewer-canvas");
+	const inspector = viewer.querySelector(".viewer-inspector");
+	const layerList = viewer.querySelector(".viewer-layers");
+
+	let level = null; // from the JSON API
+	const cells = new Map(); // "x,y" -> [{layer, tile}], topmost first
+	const hidden = new Set(); // names of hidden layers
+	let svg = null;
+	let tileSize = 0; // in SVG units
+	let cursor = null; // rect highlighting the current cell
+	let current = null; // cell shown in the inspector
+	let pinned = false; // whether the current cell was clicked on
+	let zoom = 1, panX = 0, panY = 0;
+
+	Promise.all([
+		fetch(viewer.dataset.svg).then(check).then(r => r.text()),
+		fetch(viewer.dataset.tiles).then(check).then(r => r.json()),
+	]).then(([svgText, tiles]) => {
+		canvas.innerHTML = svgText;
+		svg = canvas.querySelector("svg");
+		level = tiles;
+		tileSize = svg.viewBox.baseVal.width / Math.max(level.width, 1);
+		indexTiles();
+		makeLayerToggles();
+		makeCursor();
+		fit();
+		showCell(null);
+	}).catch(err => {
+		inspector.textContent = "Couldn't load the level: " + err.message;
+	});
+
+	function check(resp) {
+		if (!resp.ok) {
+			throw new Error(resp.status + " " + resp.statusText);
+		}
+		return resp;
+	}
+
+	// Group the tiles by cell. Layers come bottom first, and tiles later
+	// in a layer are drawn over earlier ones, so each tile goes on top.
+	function indexTiles() {
+		for (const layer of level.layers) {
+			for (const tile of layer.tiles) {
+				const key = tile.x + "," + tile.y;
+				if (!cells.has(key)) {
+					cells.set(key, []);
+				}
+				cells.get(key).unshift({layer: layer.name, tile: tile});
+			}
+		}
+	}
+
+	function makeLayerToggles() {
+		for (const layer of level.layers) {
+			const box = document.createElement("input");
+			box.type = "checkbox";
+			box.checked = true;
+			box.addEventListener("change", () => {
+				if (box.checked) {
+					hidden.delete(layer.name);
+				} else {
+					hidden.add(layer.name);
+				}
+				const g = svg.querySelector("#layer-" + layer.name);
+				if (g) {
+					g.style.display = box.checked ? "" : "none";
+				}
+				showCell(current);
+			});
+			const label = document.createElement("label");
+			label.append(box, " " + layer.name + " (" + layer.tiles.length + ")");
+			layerList.append(label, " ");
+		}
+	}
+
+	function makeCursor() {
+		cursor = document.createElementNS("http://www.w3.org/2000/svg", "rect");
+		cursor.setAttribute("class", "viewer-cursor");
+		cursor.setAttribute("width", tileSize);
+		cursor.setAttribute("height", tileSize);
+		cursor.style.display = "none";
+		svg.append(cursor);
+	}
+
+	// Zooming and panning
+
+	function update() {
+		canvas.style.transform = "translate(" + panX + "px, " + panY + "px) scale(" + zoom + ")";
+	}
+
+	function fit() {
+		const w = svg.width.baseVal.value, h = svg.height.baseVal.value;
+		zoom = Math.min(viewport.clientWidth / w, viewport.clientHeight / h, 4);
+		panX = (viewport.clientWidth - w * zoom) / 2;
+		panY = (viewport.clientHeight - h * zoom) / 2;
+		update();
+	}
+
+	// Zoom by factor, keeping the point (x, y) in the viewport still.
+	function zoomAt(factor, x, y) {
+		const z = Math.min(Math.max(zoom * factor, 0.05), 32);
+		panX = x - (x - panX) * z / zoom;
+		panY = y - (y - panY) * z / zoom;
+		zoom = z;
+		update();
+	}
+
+	viewer.querySelector(".viewer-controls").addEventListener("click", e => {
+		const action = e.target.dataset && e.target.dataset.zoom;
+		if (!svg || !action) {
+			return;
+		}
+		const x = viewport.clientWidth / 2, y = viewport.clientHeight / 2;
+		if (action === "in") {
+			zoomAt(1.5, x, y);
+		} else if (action === "out") {
+			zoomAt(1 / 1.5, x, y);
+		} else {
+			fit();
+		}
+	});
+
+	viewport.addEventListener("wheel", e => {
+		if (!svg) {
+			return;
+		}
+		e.preventDefault();
+		const r = viewport.getBoundingClientRect();
+		const dy = e.deltaMode === 1 ? e.deltaY * 16 : e.deltaY; // lines or pixels
+		zoomAt(Math.exp(-dy * 0.002), e.clientX - r.left, e.clientY - r.top);
+	}, {passive: false});
+
+	let drag = null;
+
+	viewport.addEventListener("pointerdown", e => {
+		if (!svg || e.button !== 0) {
+			return;
+		}
+		drag = {x: e.clientX, y: e.clientY, panX: panX, panY: panY, moved: false};
+		viewport.setPointerCapture(e.pointerId);
+	});
+
+	viewport.addEventListener("pointermove", e => {
+		if (!svg) {
+			return;
+		}
+		if (drag) {
+			const dx = e.clientX - drag.x, dy = e.clientY - drag.y;
+			if (Math.abs(dx) + Math.abs(dy) > 3) {
+				drag.moved = true;
+				viewport.classList.add("dragging");
+			}
+			if (drag.moved) {
+				panX = drag.panX + dx;
+				panY = drag.panY + dy;
+				update();
+			}
+			return;
+		}
+		if (!pinned) {
+			showCell(cellAt(e));
+		}
+	});
+
+	viewport.addEventListener("pointerup", e => {
+		if (drag && !drag.moved) {
+			// A click pins the cell, or unpins it if it was already pinned
+			const c = cellAt(e);
+			if (pinned && c && current && c.x === current.x && c.y === current.y) {
+				pinned = false;
+			} else {
+				pinned = c !== null;
+			}
+			showCell(c);
+		}
+		drag = null;
+		viewport.classList.remove("dragging");
+	});
+
+	viewport.addEventListener("pointerleave", () => {
+		if (!pinned && !drag) {
+			showCell(null);
+		}
+	});
+
+	document.addEventListener("keydown", e => {
+		if (e.key === "Escape" && pinned) {
+			pinned = false;
+			showCell(null);
+		}
+	});
+
+	// Returns the cell under the pointer, or null if it's outside the level.
+	function cellAt(e) {
+		const r = svg.getBoundingClientRect();
+		const x = Math.floor((e.clientX - r.left) / r.width * level.width);
+		const y = Math.floor((e.clientY - r.top) / r.height * level.height);
+		if (x < 0 || y < 0 || x >= level.width || y >= level.height) {
+			return null;
+		}
+		return {x: x, y: y};
+	}
+
+	// The inspector
+
+	function el(tag, text, className) {
+		const e = document.createElement(tag);
+		if (text !== undefined) {
+			e.textContent = text;
+		}
+		if (className) {
+			e.className = className;
+		}
+		return e;
+	}
+
+	function showCell(c) {
+		current = c;
+		if (!level) {
+			return;
+		}
+		if (!c) {
+			cursor.style.display = "none";
+			inspector.replaceChildren(el("p", "Hover over a cell to see what's in it."));
+			return;
+		}
+		cursor.style.display = "";
+		cursor.setAttribute("x", c.x * tileSize);
+		cursor.setAttribute("y", c.y * tileSize);
+		cursor.classList.toggle("pinned", pinned);
+
+		const stack = cells.get(c.x + "," + c.y) || [];
+		const children = [el("h2", "(" + c.x + ", " + c.y + ")" + (pinned ? " — selected" : ""))];
+		if (stack.length === 0) {
+			children.push(el("p", "Nothing here."));
+		}
+		for (const {layer, tile} of stack) {
+			children.push(tileInfo(layer, tile));
+		}
+		inspector.replaceChildren(...children);
+	}
+
+	function tileInfo(layer, tile) {
+		const div = el("div", undefined, "viewer-tile");
+		if (hidden.has(layer)) {
+			div.classList.add("hidden-layer");
+		}
+		div.append(el("h3", tile.type_name + " (" + tile.type + ") in " + layer));
+		const table = el("table");
+		const row = (label, value, className) => {
+			const tr = el("tr", undefined, className);
+			tr.append(el("th", label), el("td", String(value)));
+			table.append(tr);
+		};
+		row("name", tile.name, tile.name !== tile.type_name ? "mismatch" : "");
+		row("direction", tile.direction);
+		row("flags", tile.flags + " (0x" + tile.flags.toString(16) + ")");
+		row("image_index", tile.image_index, tile.image_index !== tile.type ? "mismatch" : "");
+		row("editor_category", tile.editor_category);
+		row("position in layer", tile.index);
+		for (const [k, v] of Object.entries(tile.extra || {})) {
+			row(k, v, "extra");
+		}
+		div.append(table);
+		return div;
+	}
+})();
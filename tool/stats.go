@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+
+	"github.com/magical/cc3d"
+)
+
+// How many authors and level sizes -stats lists
+const maxStatsRows = 10
+
+// Print statistics about the levels in the given directories,
+// from their metadata databases.
+func statsMain() {
+	paths := flag.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	records := readRecords(levelFiles(paths))
+	fmt.Println("levels:", len(records))
+	if len(records) == 0 {
+		return
+	}
+
+	var converts, warnings int
+	authors := make(map[string]int)
+	sizes := make(map[string]int)
+	levelsWith := make(map[int]int) // levels containing each tile type
+	tileCount := make(map[int]int)
+	for _, rec := range records {
+		if rec.Converts {
+			converts++
+		}
+		if len(rec.Warnings) > 0 {
+			warnings++
+		}
+		authors[def(rec.Author, "Author Unknown")]++
+		sizes[fmt.Sprintf("%dx%d", rec.Width, rec.Height)]++
+		for t, n := range rec.Tiles {
+			levelsWith[t]++
+			tileCount[t] += n
+		}
+	}
+	percent := func(n int) float64 { return float64(n) * 100 / float64(len(records)) }
+	fmt.Printf("convert to C2M: %d (%.1f%%)\n", converts, percent(converts))
+	fmt.Printf("with warnings: %d (%.1f%%)\n", warnings, percent(warnings))
+
+	fmt.Println()
+	fmt.Println("authors:", len(authors))
+	for _, k := range topKeys(authors, maxStatsRows) {
+		fmt.Printf("%6d %s\n", authors[k], k)
+	}
+
+	fmt.Println()
+	fmt.Println("sizes:")
+	for _, k := range topKeys(sizes, maxStatsRows) {
+		fmt.Printf("%6d %s\n", sizes[k], k)
+	}
+
+	fmt.Println()
+	fmt.Println("tiles (levels, total):")
+	types := make([]int, 0, len(levelsWith))
+	for t := range levelsWith {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		if levelsWith[types[i]] != levelsWith[types[j]] {
+			return levelsWith[types[i]] > levelsWith[types[j]]
+		}
+		return types[i] < types[j]
+	})
+	for _, t := range types {
+		fmt.Printf("%6d %8d  %3d %s\n", levelsWith[t], tileCount[t], t, cc3d.TileName(t))
+	}
+}
+
+// Returns the n keys with the highest counts.
+func topKeys(counts map[string]int, n int) []string {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
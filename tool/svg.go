@@ -0,0 +1,139 @@
+package main
+
+// SVG level maps
+//
+// Each tile is a <use> element referring to a sprite, with a <title> tooltip.
+// Tiles are grouped by layer, so that layers can be styled or hidden individually.
+// Sprites are either embedded as data: URLs or linked to tile/<type>_<dir>.png
+// and tile/<type>_<dir>_arrow.png (see serveTileImage).
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"image"
+	"image/png"
+	"io"
+	"os"
+
+	"github.com/magical/cc3d"
+)
+
+// The order in which layers are drawn. Same as makeMap.
+var drawOrder = []string{"switches", "tiles", "walls", "objects", "blocks", "enemies", "player"}
+
+type svgWriter struct {
+	w        *bufio.Writer
+	link     bool
+	size     int
+	sprites  map[image.Image]string // embedded sprite ids
+	defs     bytes.Buffer
+	nsprites int
+}
+
+// Write an SVG map of a level.
+// If link is true, sprites are linked rather than embedded.
+// The map is drawn with the tileset's tiles and scaled to opts.Size.
+// Annotations aren't supported.
+func writeSVG(w io.Writer, m *cc3d.Map, tileset Tileset, opts mapOptions, link bool) error {
+	if opts.Unexpected || opts.Grid || opts.Connections || opts.Diagnostics {
+		return errors.New("SVG maps can't be annotated; use PNG output instead")
+	}
+	sw := &svgWriter{
+		w:       bufio.NewWriter(w),
+		link:    link,
+		sprites: make(map[image.Image]string),
+	}
+	size := tileset.TileSize()
+	sw.size = size
+	view := opts.bounds(m, size)
+	display := view
+	if opts.Size > 0 {
+		display = opts.bounds(m, opts.Size)
+	}
+
+	// Write the tiles to a buffer first so that we know which sprites we need
+	var body bytes.Buffer
+	layers := make(map[string][]cc3d.Tile)
+	for _, l := range m.Layers() {
+		layers[l.Name] = l.Tiles
+	}
+	base := make(map[image.Point]bool)
+	for _, layer := range drawOrder {
+		if !opts.showLayer(layer) {
+			continue
+		}
+		fmt.Fprintf(&body, "<g id=\"layer-%s\" class=\"layer\">\n", layer)
+		for _, t := range layers[layer] {
+			r := opts.cellRect(m, size, t.X/64, t.Y/64)
+			x, y := r.Min.X, r.Min.Y
+			src := warnMissingTileImage(t, tileset.TileImage(t))
+			opacity := ""
+			if src != nil && isMostlyOpaque(src) && base[image.Pt(t.X, t.Y)] {
+				opacity = ` opacity="0.5"`
+			}
+			name := t.Attributes.Name
+			if name == "" {
+				name = cc3d.TileName(t.Type)
+			}
+			fmt.Fprintf(&body, `<g class="tile" data-x="%d" data-y="%d" data-type="%d" data-dir="%d"%s>`, t.X/64, t.Y/64, t.Type, t.Direction, opacity)
+			fmt.Fprintf(&body, "<title>(%d,%d) %s: %d %s, direction %d</title>", t.X/64, t.Y/64, layer, t.Type, html.EscapeString(name), t.Direction)
+			if src != nil {
+				fmt.Fprintf(&body, `<use href="%s" x="%d" y="%d"/>`, sw.sprite(src, fmt.Sprintf("tile/%d_%d.png", t.Type, t.Direction)), x, y)
+			}
+			if dir := tileset.Direction(t); dir != nil {
+				fmt.Fprintf(&body, `<use href="%s" x="%d" y="%d"/>`, sw.sprite(dir, fmt.Sprintf("tile/%d_%d_arrow.png", t.Type, t.Direction)), x, y)
+			}
+			body.WriteString("</g>\n")
+			if t.Type != 1 {
+				base[image.Pt(t.X, t.Y)] = true
+			}
+		}
+		body.WriteString("</g>\n")
+	}
+
+	bw := sw.w
+	fmt.Fprintf(bw, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`+"\n", display.Dx(), display.Dy(), view.Dx(), view.Dy())
+	fmt.Fprintf(bw, "<title>%s by %s</title>\n", html.EscapeString(def(m.Name, "Untitled")), html.EscapeString(def(m.Author, "Author Unknown")))
+	bw.WriteString("<defs>\n")
+	bw.Write(sw.defs.Bytes())
+	bw.WriteString("</defs>\n")
+	bw.Write(body.Bytes())
+	bw.WriteString("</svg>\n")
+	return bw.Flush()
+}
+
+// Returns a reference to a sprite, adding it to the defs if necessary.
+func (sw *svgWriter) sprite(im image.Image, linkPath string) string {
+	if id, ok := sw.sprites[im]; ok {
+		return "#" + id
+	}
+	id := fmt.Sprintf("s%d", sw.nsprites)
+	sw.nsprites++
+	sw.sprites[im] = id
+	var href string
+	if sw.link {
+		href = linkPath
+	} else {
+		var buf bytes.Buffer
+		png.Encode(&buf, im)
+		href = "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+	}
+	fmt.Fprintf(&sw.defs, `<image id="%s" width="%d" height="%d" href="%s"/>`+"\n", id, sw.size, sw.size, html.EscapeString(href))
+	return "#" + id
+}
+
+func writeSVGFile(filename string, m *cc3d.Map, tileset Tileset, opts mapOptions) error {
+	out, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if err := writeSVG(out, m, tileset, opts, false); err != nil {
+		return err
+	}
+	return out.Close()
+}
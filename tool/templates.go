@@ -0,0 +1,201 @@
+package main
+
+// HTML templates for the level server
+//
+// Pages are rendered with html/template. The templates and static files
+// are built into the binary, but either can be overridden with -templates
+// and -static: a file in those directories replaces the built-in file of
+// the same name, so a theme only needs to include the files it changes.
+//
+// Each page is a file in templates/ which defines "title" and "content"
+// (and optionally "head" and "nav"), and is executed as the "layout" template
+// from layout.html. Every page's data has the fields of pageData.
+// Static files are served from static/ under each collection.
+
+import (
+	"bytes"
+	"embed"
+	"flag"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//go:embed templates static
+var webFiles embed.FS
+
+var (
+	templatesFlag = flag.String("templates", "", "directory of HTML templates which override the built-in ones for -http")
+	staticFlag    = flag.String("static", "", "directory of static files which override the built-in ones for -http")
+)
+
+var pageNames = []string{"collections", "index", "info", "diff", "authors", "author", "upload", "viewer"}
+
+// Parsed templates for each page.
+type pageTemplates map[string]*template.Template
+
+var templateFuncs = template.FuncMap{
+	"def": def,
+}
+
+// Parse the page templates, preferring files in dir to the built-in ones.
+func loadTemplates(dir string) (pageTemplates, error) {
+	layout, err := readTemplate(dir, "layout.html")
+	if err != nil {
+		return nil, err
+	}
+	pages := make(pageTemplates)
+	for _, name := range pageNames {
+		text, err := readTemplate(dir, name+".html")
+		if err != nil {
+			return nil, err
+		}
+		t, err := template.New(name).Funcs(templateFuncs).Parse(layout)
+		if err == nil {
+			_, err = t.Parse(text)
+		}
+		if err != nil {
+			return nil, err
+		}
+		pages[name] = t
+	}
+	return pages, nil
+}
+
+func readTemplate(dir, name string) (string, error) {
+	if dir != "" {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err == nil {
+			return string(data), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	data, err := fs.ReadFile(webFiles, "templates/"+name)
+	return string(data), err
+}
+
+// Render a page.
+// The page is rendered in full before anything is sent,
+// so that errors in a template result in a 500 rather than half a page.
+func (pt pageTemplates) render(w http.ResponseWriter, name string, data interface{}) {
+	var buf bytes.Buffer
+	if err := pt[name].ExecuteTemplate(&buf, "layout", data); err != nil {
+		log.Println(err)
+		http.Error(w, "500 internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// Serve a file from the -static directory or the built-in static files.
+func serveStatic(w http.ResponseWriter, req *http.Request, name string) {
+	builtin, _ := fs.Sub(webFiles, "static")
+	dirs := []http.FileSystem{http.FS(builtin)}
+	if *staticFlag != "" {
+		dirs = append([]http.FileSystem{http.Dir(*staticFlag)}, dirs...)
+	}
+	for _, dir := range dirs {
+		f, err := dir.Open("/" + name)
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil || fi.IsDir() {
+			continue
+		}
+		http.ServeContent(w, req, fi.Name(), fi.ModTime(), f)
+		return
+	}
+	http.NotFound(w, req)
+}
+
+// Data shared by every page.
+type pageData struct {
+	Site string // title of the collection
+	Root string // relative URL of the collection's index page
+}
+
+func (s *server) pageData(req *http.Request) pageData {
+	rel := strings.TrimPrefix(req.URL.EscapedPath(), s.mount)
+	return pageData{
+		Site: s.title,
+		Root: strings.Repeat("../", strings.Count(rel, "/")),
+	}
+}
+
+// A level in a list of levels.
+type levelEntry struct {
+	ID            string
+	Name, Author  string
+	Width, Height int
+	Known         bool   // whether the level has been indexed
+	Note          string // e.g. "doesn't convert"
+}
+
+func entryFor(li levelInfo) levelEntry {
+	return levelEntry{
+		ID:     li.ID,
+		Name:   li.Name,
+		Author: li.Author,
+		Width:  li.Width,
+		Height: li.Height,
+		Known:  true,
+	}
+}
+
+// A page of a long list.
+type pagination struct {
+	Page, Pages int
+	Start       int    // position of the first item on the page, counting from 1
+	Prev, Next  string // links to the neighbouring pages; empty if there isn't one
+}
+
+// Work out which of n items go on the page given by the form's page parameter.
+func paginate(form url.Values, n, pageSize int) (p pagination, start, end int) {
+	page, err := strconv.Atoi(def(form.Get("page"), "1"))
+	if err != nil {
+		page = 1
+	}
+	pages := (n + pageSize - 1) / pageSize
+	if pages < 1 {
+		pages = 1
+	}
+	page = clamp(page, 1, pages)
+	start = (page - 1) * pageSize
+	end = start + pageSize
+	if end > n {
+		end = n
+	}
+	p = pagination{Page: page, Pages: pages, Start: start + 1}
+	if page > 1 {
+		p.Prev = formLink(form, "page", strconv.Itoa(page-1))
+	}
+	if page < pages {
+		p.Next = formLink(form, "page", strconv.Itoa(page+1))
+	}
+	return p, start, end
+}
+
+// A link to the current page with one form parameter changed.
+// Changing anything but the page goes back to the first page.
+func formLink(form url.Values, key, value string) string {
+	v := url.Values{}
+	for k, vs := range form {
+		v[k] = vs
+	}
+	v.Set(key, value)
+	if key != "page" {
+		v.Del("page")
+	}
+	return "?" + v.Encode()
+}
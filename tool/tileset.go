@@ -0,0 +1,477 @@
+package main
+
+// Tileset manifests
+//
+// A tileset is described by a JSON manifest which maps tile types to images.
+// Images come from sources, which are either a directory of PNG files
+// or a single PNG sprite sheet divided into a grid of square tiles.
+// An image is referred to as "source:name" for directories
+// or "source:x,y" for sprite sheets (in grid coordinates, not pixels).
+//
+//    {
+//      "sources": {
+//        "cc3d": {"directory": "ChucksChallengeImages", "trim_suffix": "CreatorThumbnail"},
+//        "tw": {"sheet": "tworld.png", "tile_size": 48, "transparent": "#ff00ff"}
+//      },
+//      "arrows": ["cc3d:ArrowN", "cc3d:ArrowE", "cc3d:ArrowS", "cc3d:ArrowW"],
+//      "directional": [67, 68],
+//      "tiles": [
+//        {"type": 1, "name": "Floor Tile", "image": "cc3d:Floor2"},
+//        {"types": [147, 148, 149, 150], "dir": 0, "name": "Panel", "image": "cc3d:PanelE"},
+//        {"type": 4, "name": "Ice corner SW", "image": "tw:1,13"}
+//      ]
+//    }
+//
+// A tile may be listed more than once; the first entry whose image exists
+// and whose direction matches (if given) is used.
+// Tiles whose types are listed in "directional" get an arrow drawn on top of them,
+// unless their image was chosen by direction. If "directional" is omitted,
+// the CC3D tile types which have a direction are used.
+//
+// Entries can also modify their image, for tiles which don't have art of their own:
+// "tint" (#rrggbb) recolors the image, "scale" shrinks it (e.g. 0.7),
+// and "label" writes a few letters on top of it.
+//
+// The default tileset is embedded in the binary,
+// along with a tileset for rendering converted C2M levels.
+
+import (
+	"embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/magical/cc3d"
+	"github.com/nfnt/resize"
+)
+
+//go:embed tileset
+var embeddedTileset embed.FS
+
+var (
+	tilesetFlag    = flag.String("tileset", "", "tileset manifest to use instead of the built-in tileset")
+	c2mTilesetFlag = flag.String("c2mtileset", "", "tileset manifest to use for C2M levels instead of the built-in tileset")
+)
+
+// Load the tileset selected by -tileset, scaled to the given size.
+func loadTiles(size int) Tileset {
+	return loadTilesetFile(*tilesetFlag, "default.json", size)
+}
+
+// Load the tileset for C2M levels selected by -c2mtileset.
+// Tile types in this tileset are C2M tile IDs.
+func loadC2MTiles(size int) Tileset {
+	return loadTilesetFile(*c2mTilesetFlag, "c2m.json", size)
+}
+
+// Load a tileset manifest from disk,
+// or the named built-in manifest if filename is empty.
+func loadTilesetFile(filename, builtin string, size int) Tileset {
+	var fsys fs.FS
+	var name string
+	if filename != "" {
+		fsys = os.DirFS(filepath.Dir(filename))
+		name = filepath.Base(filename)
+	} else {
+		fsys, _ = fs.Sub(embeddedTileset, "tileset")
+		name = builtin
+	}
+	ts, err := LoadTileset(fsys, name, size)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return ts
+}
+
+// A tilesetCache loads a tileset at each tile size on first use.
+// It holds at most max tilesets, dropping the least recently used.
+type tilesetCache struct {
+	load func(size int) Tileset
+	max  int
+	mu   sync.Mutex
+	sets map[int]*tilesetEntry
+	used []int // sizes, least recently used first
+}
+
+type tilesetEntry struct {
+	ready chan struct{} // closed once ts is loaded
+	ts    Tileset
+}
+
+// Enough for every size the server draws, including thumbnails
+const maxTilesets = 10
+
+func newTilesetCache(load func(size int) Tileset, max int) *tilesetCache {
+	return &tilesetCache{load: load, max: max, sets: make(map[int]*tilesetEntry)}
+}
+
+// Get returns the tileset with tiles of the given size.
+// Tilesets are loaded without holding the lock, so that loading one size
+// doesn't hold up requests for the others; requests for a size which is
+// being loaded wait for it.
+func (c *tilesetCache) get(size int) Tileset {
+	c.mu.Lock()
+	e, ok := c.sets[size]
+	if !ok {
+		e = &tilesetEntry{ready: make(chan struct{})}
+		c.sets[size] = e
+	}
+	c.touch(size)
+	c.mu.Unlock()
+	if !ok {
+		e.ts = c.load(size)
+		close(e.ready)
+	}
+	<-e.ready
+	return e.ts
+}
+
+// Marks size as the most recently used and drops the oldest tilesets
+// if there are too many. Requests already waiting on a dropped tileset still get it.
+// Must be called with c.mu held.
+func (c *tilesetCache) touch(size int) {
+	for i, s := range c.used {
+		if s == size {
+			c.used = append(c.used[:i], c.used[i+1:]...)
+			break
+		}
+	}
+	c.used = append(c.used, size)
+	for len(c.used) > c.max {
+		delete(c.sets, c.used[0])
+		c.used = c.used[1:]
+	}
+}
+
+type tilesetManifest struct {
+	Sources     map[string]tileSource `json:"sources"`
+	Arrows      []string              `json:"arrows"`
+	Directional []int                 `json:"directional"` // nil for the CC3D types
+	Tiles       []tileEntry           `json:"tiles"`
+}
+
+type tileSource struct {
+	// Directory sources
+	Directory  string `json:"directory"`
+	TrimSuffix string `json:"trim_suffix"` // optional suffix on file names
+
+	// Sprite sheet sources
+	Sheet       string `json:"sheet"`
+	TileSize    int    `json:"tile_size"`
+	Transparent string `json:"transparent"` // color to make transparent, as #rrggbb
+}
+
+type tileEntry struct {
+	Type  int    `json:"type"`
+	Types []int  `json:"types"`
+	Dir   *int   `json:"dir"`
+	Name  string `json:"name"` // for documentation only
+	Image string `json:"image"`
+
+	Tint  string  `json:"tint"`
+	Scale float64 `json:"scale"`
+	Label string  `json:"label"`
+}
+
+// A ManifestTileset is a tileset loaded from a manifest.
+type ManifestTileset struct {
+	size        int
+	tiles       map[int][]tileChoice
+	arrows      [4]image.Image
+	directional map[int]bool
+}
+
+type tileChoice struct {
+	dir int // -1 for any direction
+	im  image.Image
+}
+
+// LoadTileset loads a tileset from the manifest with the given name in fsys.
+// Paths in the manifest are relative to the manifest.
+// Tiles are scaled to size x size pixels.
+func LoadTileset(fsys fs.FS, name string, size int) (*ManifestTileset, error) {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, fmt.Errorf("error loading tileset: %w", err)
+	}
+	var manifest tilesetManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("error loading tileset %q: %w", name, err)
+	}
+	l := &tileLoader{
+		fsys:     fsys,
+		dir:      path.Dir(name),
+		manifest: &manifest,
+		size:     size,
+		sheets:   make(map[string]*image.RGBA),
+		cache:    make(map[string]image.Image),
+	}
+	ts := &ManifestTileset{
+		size:        size,
+		tiles:       make(map[int][]tileChoice),
+		directional: make(map[int]bool),
+	}
+	if len(manifest.Arrows) != 0 && len(manifest.Arrows) != 4 {
+		return nil, fmt.Errorf("error loading tileset %q: need four arrows, one for each direction", name)
+	}
+	for i, ref := range manifest.Arrows {
+		im, err := l.load(ref)
+		if err != nil {
+			return nil, err
+		}
+		ts.arrows[i] = im
+	}
+	if manifest.Directional != nil {
+		for _, typ := range manifest.Directional {
+			ts.directional[typ] = true
+		}
+	} else {
+		for _, typ := range cc3d.TileTypes() {
+			ts.directional[typ] = cc3d.HasDirection(typ)
+		}
+	}
+	for _, e := range manifest.Tiles {
+		im, err := l.load(e.Image)
+		if err != nil {
+			return nil, err
+		}
+		if im == nil {
+			log.Printf("warning: tileset: missing image %s for %d %s", e.Image, e.Type, e.Name)
+			continue
+		}
+		im, err = transformTile(im, e, size)
+		if err != nil {
+			return nil, fmt.Errorf("error loading tileset: %s: %w", e.Image, err)
+		}
+		dir := -1
+		if e.Dir != nil {
+			dir = *e.Dir
+		}
+		types := e.Types
+		if len(types) == 0 {
+			types = []int{e.Type}
+		}
+		for _, typ := range types {
+			ts.tiles[typ] = append(ts.tiles[typ], tileChoice{dir, im})
+		}
+	}
+	return ts, nil
+}
+
+type tileLoader struct {
+	fsys     fs.FS
+	dir      string // directory containing the manifest
+	manifest *tilesetManifest
+	size     int
+	sheets   map[string]*image.RGBA
+	cache    map[string]image.Image
+}
+
+// Load an image reference.
+// Returns nil, nil if the image doesn't exist in a directory source.
+func (l *tileLoader) load(ref string) (image.Image, error) {
+	if im, ok := l.cache[ref]; ok {
+		return im, nil
+	}
+	srcName, name, _ := cut(ref, ":")
+	src, ok := l.manifest.Sources[srcName]
+	if !ok {
+		return nil, fmt.Errorf("error loading tileset: %s: unknown source %q", ref, srcName)
+	}
+	var im image.Image
+	var err error
+	if src.Sheet != "" {
+		im, err = l.loadSprite(src, name)
+	} else {
+		im, err = l.loadFile(src, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error loading tileset: %s: %w", ref, err)
+	}
+	if im != nil && (im.Bounds().Dx() != l.size || im.Bounds().Dy() != l.size) {
+		im = resize.Resize(uint(l.size), uint(l.size), im, resize.Bilinear)
+	}
+	l.cache[ref] = im
+	return im, nil
+}
+
+func (l *tileLoader) loadFile(src tileSource, name string) (image.Image, error) {
+	dir := path.Join(l.dir, src.Directory)
+	f, err := l.fsys.Open(path.Join(dir, name+".png"))
+	if err != nil && src.TrimSuffix != "" {
+		f, err = l.fsys.Open(path.Join(dir, name+src.TrimSuffix+".png"))
+	}
+	if err != nil {
+		return nil, nil
+	}
+	defer f.Close()
+	return png.Decode(f)
+}
+
+func (l *tileLoader) loadSprite(src tileSource, pos string) (image.Image, error) {
+	xs, ys, _ := cut(pos, ",")
+	x, errx := strconv.Atoi(xs)
+	y, erry := strconv.Atoi(ys)
+	if errx != nil || erry != nil {
+		return nil, fmt.Errorf("invalid sprite position %q", pos)
+	}
+	sheet, err := l.loadSheet(src)
+	if err != nil {
+		return nil, err
+	}
+	n := src.TileSize
+	r := image.Rect(x*n, y*n, (x+1)*n, (y+1)*n)
+	if !r.In(sheet.Bounds()) {
+		return nil, fmt.Errorf("sprite position %q is outside of %s", pos, src.Sheet)
+	}
+	return sheet.SubImage(r), nil
+}
+
+func (l *tileLoader) loadSheet(src tileSource) (*image.RGBA, error) {
+	if sheet, ok := l.sheets[src.Sheet]; ok {
+		return sheet, nil
+	}
+	if src.TileSize <= 0 {
+		return nil, fmt.Errorf("%s: missing tile_size", src.Sheet)
+	}
+	f, err := l.fsys.Open(path.Join(l.dir, src.Sheet))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	im, err := png.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", src.Sheet, err)
+	}
+	sheet, ok := im.(*image.RGBA)
+	if !ok {
+		sheet = image.NewRGBA(im.Bounds())
+		draw.Draw(sheet, sheet.Rect, im, im.Bounds().Min, draw.Src)
+	}
+	if src.Transparent != "" {
+		c, err := parseHexColor(src.Transparent)
+		if err != nil {
+			return nil, err
+		}
+		makeTransparent(sheet, c)
+	}
+	l.sheets[src.Sheet] = sheet
+	return sheet, nil
+}
+
+// Apply an entry's tint, scale, and label to an image.
+func transformTile(im image.Image, e tileEntry, size int) (image.Image, error) {
+	if e.Tint == "" && e.Scale == 0 && e.Label == "" {
+		return im, nil
+	}
+	out := image.NewRGBA(image.Rect(0, 0, size, size))
+	if e.Scale > 0 && e.Scale != 1 {
+		n := int(float64(size)*e.Scale + 0.5)
+		small := resize.Resize(uint(n), uint(n), im, resize.Bilinear)
+		off := (size - n) / 2
+		draw.Draw(out, image.Rect(off, off, off+n, off+n), small, small.Bounds().Min, draw.Src)
+	} else {
+		draw.Draw(out, out.Rect, im, im.Bounds().Min, draw.Src)
+	}
+	if e.Tint != "" {
+		c, err := parseHexColor(e.Tint)
+		if err != nil {
+			return nil, err
+		}
+		tint(out, c)
+	}
+	if e.Label != "" {
+		scale := size / 16
+		if scale < 1 {
+			scale = 1
+		}
+		sz := textSize(e.Label, scale)
+		p := image.Pt((size-sz.X)/2, (size-sz.Y)/2)
+		drawOutlinedText(out, p, e.Label, scale, color.White, color.Black)
+	}
+	return out, nil
+}
+
+// Recolor an image, keeping its brightness.
+func tint(im *image.RGBA, c color.RGBA) {
+	for i := 0; i+3 < len(im.Pix); i += 4 {
+		p := im.Pix[i : i+4]
+		// luma of the premultiplied color, relative to 3/4 brightness
+		// so that the tint color shows up at typical brightness
+		lum := (299*int(p[0]) + 587*int(p[1]) + 114*int(p[2])) / 1000
+		scale := func(v uint8) uint8 {
+			x := int(v) * lum / 0xc0
+			if x > int(p[3]) {
+				x = int(p[3])
+			}
+			return uint8(x)
+		}
+		p[0], p[1], p[2] = scale(c.R), scale(c.G), scale(c.B)
+	}
+}
+
+// Parse a color in #rrggbb format.
+func parseHexColor(s string) (color.RGBA, error) {
+	v, err := strconv.ParseUint(strings.TrimPrefix(s, "#"), 16, 32)
+	if err != nil || len(strings.TrimPrefix(s, "#")) != 6 {
+		return color.RGBA{}, fmt.Errorf("invalid color %q", s)
+	}
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 0xff}, nil
+}
+
+// Replace all pixels of the given color with transparent pixels.
+func makeTransparent(im *image.RGBA, c color.RGBA) {
+	dim := im.Rect.Size()
+	for y := 0; y < dim.Y; y++ {
+		i := im.Stride * y
+		for x := 0; x < dim.X; x++ {
+			p := im.Pix[i : i+4]
+			if p[0] == c.R && p[1] == c.G && p[2] == c.B && p[3] == c.A {
+				p[0], p[1], p[2], p[3] = 0, 0, 0, 0
+			}
+			i += 4
+		}
+	}
+}
+
+func (ts *ManifestTileset) Direction(t cc3d.Tile) image.Image {
+	if ts.directional[t.Type] && 0 <= t.Direction && t.Direction < 4 {
+		if c := ts.choice(t); c != nil && c.dir >= 0 {
+			return nil // the image already shows the direction
+		}
+		return ts.arrows[t.Direction]
+	}
+	return nil
+}
+
+func (ts *ManifestTileset) TileSize() int { return ts.size }
+
+func (ts *ManifestTileset) TileImage(t cc3d.Tile) image.Image {
+	if c := ts.choice(t); c != nil {
+		return c.im
+	}
+	return nil
+}
+
+// Returns the first entry for the tile which matches its direction.
+func (ts *ManifestTileset) choice(t cc3d.Tile) *tileChoice {
+	choices := ts.tiles[t.Type]
+	for i := range choices {
+		if c := &choices[i]; c.dir < 0 || c.dir == t.Direction%4 {
+			return c
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"testing"
+
+	"github.com/magical/cc3d"
+)
+
+// Check that the default tileset has an image for every known tile.
+func TestTilesetCoverage(t *testing.T) {
+	fsys, _ := fs.Sub(embeddedTileset, "tileset")
+	ts, err := LoadTileset(fsys, "default.json", defaultTileSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, typ := range cc3d.TileTypes() {
+		for dir := 0; dir < 4; dir++ {
+			if ts.TileImage(cc3d.Tile{Type: typ, Direction: dir}) == nil {
+				t.Errorf("%d %s: no image for direction %d", typ, cc3d.TileName(typ), dir)
+			}
+		}
+	}
+}
+
+func TestTilesetCacheLimit(t *testing.T) {
+	var loads []int
+	c := newTilesetCache(func(size int) Tileset {
+		loads = append(loads, size)
+		return nil
+	}, 2)
+	for _, size := range []int{16, 24, 16, 32, 16, 24} {
+		c.get(size)
+	}
+	// 24 is dropped when 32 is loaded, since 16 was used more recently
+	want := []int{16, 24, 32, 24}
+	if fmt.Sprint(loads) != fmt.Sprint(want) {
+		t.Errorf("loaded sizes %v, want %v", loads, want)
+	}
+	if len(c.sets) != 2 {
+		t.Errorf("cache holds %d tilesets, want 2", len(c.sets))
+	}
+}
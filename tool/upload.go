@@ -0,0 +1,225 @@
+package main
+
+// Level uploads
+//
+// Levels are uploaded by POSTing a CC3D .xml or .xml.gz file to upload,
+// either as the request body or as the "level" field of a multipart form.
+// The upload token from the -config file must be given in an
+// "Authorization: Bearer <token>" header or a "token" form field.
+// The token is checked before the level is read, so the form field
+// has to come before the level.
+// GET upload shows a form.
+//
+// Uploads are parsed with cc3d.DefaultLimits. Levels which can't be parsed
+// or are too large are rejected; the rest are saved under the next
+// free level id and indexed right away. The response is JSON listing
+// the problems found by cc3d.Diagnose and whether the level converts to C2M.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/magical/cc3d"
+)
+
+// Largest upload we accept, before decompression
+const maxUploadBytes = 16 << 20
+
+type uploadResult struct {
+	Accepted     bool         `json:"accepted"`
+	ID           string       `json:"id,omitempty"`
+	URL          string       `json:"url,omitempty"`
+	Error        string       `json:"error,omitempty"`
+	Warnings     []apiWarning `json:"warnings"`
+	Converts     bool         `json:"converts"`
+	ConvertError string       `json:"convert_error,omitempty"`
+}
+
+func (s *server) serveUpload(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "GET" {
+		s.serveUploadForm(w, req)
+		return
+	}
+	if s.uploadToken == "" {
+		writeJSONError(w, &httpError{http.StatusForbidden, errors.New("uploads are disabled")})
+		return
+	}
+	authorized := false
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		if !s.validUploadToken(strings.TrimPrefix(auth, "Bearer ")) {
+			writeJSONError(w, errBadUploadToken)
+			return
+		}
+		authorized = true
+	}
+	req.Body = http.MaxBytesReader(w, req.Body, maxUploadBytes)
+
+	var data []byte
+	var err error
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/form-data") {
+		data, err = s.readUploadForm(req, authorized)
+	} else if !authorized {
+		err = errBadUploadToken
+	} else {
+		data, err = io.ReadAll(req.Body)
+	}
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			err = &httpError{http.StatusRequestEntityTooLarge, fmt.Errorf("upload is larger than %d bytes", maxUploadBytes)}
+		} else if _, ok := err.(*httpError); !ok {
+			err = &httpError{http.StatusBadRequest, err}
+		}
+		writeJSONError(w, err)
+		return
+	}
+
+	res := uploadResult{Warnings: []apiWarning{}}
+	m, err := cc3d.ReadLevelLimits(bytes.NewReader(data), cc3d.DefaultLimits)
+	if err != nil {
+		res.Error = err.Error()
+		writeJSONStatus(w, http.StatusUnprocessableEntity, res)
+		return
+	}
+	res.Warnings = diagnose(m)
+	if _, err := encodeLevel(m); err != nil {
+		res.ConvertError = err.Error()
+	} else {
+		res.Converts = true
+	}
+
+	id, err := s.storeLevel(data)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	res.Accepted = true
+	res.ID = id
+	res.URL = id
+	w.Header().Set("Location", id)
+	writeJSONStatus(w, http.StatusCreated, res)
+}
+
+var errBadUploadToken = &httpError{http.StatusUnauthorized, errors.New("missing or invalid upload token")}
+
+// Longest token form field we read
+const maxTokenBytes = 1024
+
+func (s *server) validUploadToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.uploadToken)) == 1
+}
+
+// Read the level from a multipart form, reading the token field first
+// unless the request was already authorized by its header.
+// Other fields are skipped.
+func (s *server) readUploadForm(req *http.Request, authorized bool) ([]byte, error) {
+	mr, err := req.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, errors.New("level: no file uploaded")
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch p.FormName() {
+		case "token":
+			if authorized {
+				continue
+			}
+			token, err := io.ReadAll(io.LimitReader(p, maxTokenBytes))
+			if err != nil {
+				return nil, err
+			}
+			if !s.validUploadToken(string(token)) {
+				return nil, errBadUploadToken
+			}
+			authorized = true
+		case "level":
+			if !authorized {
+				return nil, errBadUploadToken
+			}
+			return io.ReadAll(p)
+		}
+	}
+}
+
+// Save a level under the next free id and add it to the index.
+// Levels which aren't already gzipped are compressed.
+func (s *server) storeLevel(data []byte) (string, error) {
+	if !bytes.HasPrefix(data, gzipMagic) {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.ModTime = time.Now()
+		zw.Write(data)
+		if err := zw.Close(); err != nil {
+			return "", err
+		}
+		data = buf.Bytes()
+	}
+
+	s.uploadMu.Lock()
+	defer s.uploadMu.Unlock()
+	n := s.nextID()
+	for {
+		id := strconv.Itoa(n)
+		filename := filepath.Join(s.levelDir, id+".xml.gz")
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if errors.Is(err, os.ErrExist) {
+			n++
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		_, err = f.Write(data)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(filename)
+			return "", err
+		}
+		if fi, err := os.Stat(filename); err == nil {
+			s.indexFile(filename, statStamp(fi))
+		}
+		return id, nil
+	}
+}
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Returns one more than the largest numeric level id in the directory.
+func (s *server) nextID() int {
+	files, _ := filepath.Glob(filepath.Join(s.levelDir, "*.xml.gz"))
+	max := 0
+	for _, fullname := range files {
+		id, _, _ := cut(filepath.Base(fullname), ".")
+		if n, err := strconv.Atoi(id); err == nil && n > max {
+			max = n
+		}
+	}
+	return max + 1
+}
+
+type uploadPage struct {
+	pageData
+	Enabled bool
+}
+
+func (s *server) serveUploadForm(w http.ResponseWriter, req *http.Request) {
+	s.templates.render(w, "upload", uploadPage{s.pageData(req), s.uploadToken != ""})
+}
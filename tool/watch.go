@@ -0,0 +1,109 @@
+package main
+
+// Watching level directories for changes
+//
+// There's no portable file notification API in the standard library,
+// so the server just polls: every -poll interval it rescans each level
+// directory and re-indexes files which were added or changed (see refreshIndex).
+// Progress is reported at /status.
+
+import (
+	"flag"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var pollFlag = flag.Duration("poll", 10*time.Second, "how often -http checks level directories for changes (0 to only check at startup)")
+
+// Index the server's level directory, then keep it up to date.
+func (s *server) watch(interval time.Duration) {
+	s.refreshIndex()
+	if interval <= 0 {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for range t.C {
+		s.refreshIndex()
+	}
+}
+
+// Progress of the index, for the status page.
+type indexProgress struct {
+	Scanning bool      `json:"scanning"`
+	Scans    int       `json:"scans"`     // completed scans
+	Levels   int       `json:"levels"`    // levels in the index after the last scan
+	Pending  int       `json:"pending"`   // files to read in the current scan
+	Done     int       `json:"done"`      // files read so far in the current scan
+	Errors   int       `json:"errors"`    // files which couldn't be read in the current or last scan
+	LastScan time.Time `json:"last_scan"` // when the last scan finished
+	Duration string    `json:"duration"`  // how long the last scan took
+
+	// Changes found by the last scan
+	Added   int `json:"added"`
+	Changed int `json:"changed"`
+	Removed int `json:"removed"`
+}
+
+type indexStatus struct {
+	mu    sync.Mutex
+	p     indexProgress
+	start time.Time
+}
+
+func (st *indexStatus) beginScan(pending int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.p.Scanning = true
+	st.p.Pending = pending
+	st.p.Done = 0
+	st.p.Errors = 0
+	st.start = time.Now()
+}
+
+func (st *indexStatus) fileDone(err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.p.Done++
+	if err != nil {
+		st.p.Errors++
+	}
+}
+
+func (st *indexStatus) endScan(levels, added, changed, removed int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.p.Scanning = false
+	st.p.Scans++
+	st.p.Levels = levels
+	st.p.Added, st.p.Changed, st.p.Removed = added, changed, removed
+	st.p.LastScan = time.Now().UTC()
+	st.p.Duration = time.Since(st.start).Round(time.Millisecond).String()
+}
+
+func (st *indexStatus) progress() indexProgress {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.p
+}
+
+// The collection is identified by its title and mount point,
+// so that the status doesn't reveal where the levels are stored.
+type serverStatus struct {
+	Title string        `json:"title"`
+	Mount string        `json:"mount"`
+	Index indexProgress `json:"index"`
+	Cache cacheStats    `json:"cache"`
+}
+
+// Serve the server's status as JSON.
+func (s *server) serveStatus(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache")
+	writeJSON(w, serverStatus{
+		Title: s.title,
+		Mount: s.mount,
+		Index: s.status.progress(),
+		Cache: s.cache.stats(),
+	})
+}
@@ -0,0 +1,98 @@
+package cc3d
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The layout of a level file, for writing.
+// Same as Map but without ExtraElem, which can't be written back out.
+type mapXML struct {
+	XMLName    xml.Name `xml:"map"`
+	Author     string   `xml:"author,attr"`
+	Name       string   `xml:"name,attr"`
+	Height     int      `xml:"height,attr"`
+	Width      int      `xml:"width,attr"`
+	Background int      `xml:"background,attr"`
+	Player     []Tile   `xml:"player>tile"`
+	Tiles      []Tile   `xml:"tiles>tile"`
+	Objects    []Tile   `xml:"objects>tile"`
+	Enemies    []Tile   `xml:"enemies>tile"`
+	Blocks     []Tile   `xml:"blocks>tile"`
+	Walls      []Tile   `xml:"walls>tile"`
+	Switches   []Tile   `xml:"switches>tile"`
+}
+
+// WriteLevel writes a level in CC3D's XML format.
+// Unknown top-level elements are not preserved.
+func WriteLevel(w io.Writer, m *Map) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	e := xml.NewEncoder(w)
+	e.Indent("", "  ")
+	err := e.Encode(mapXML{
+		Author:     m.Author,
+		Name:       m.Name,
+		Height:     m.Height,
+		Width:      m.Width,
+		Background: m.Background,
+		Player:     m.Player,
+		Tiles:      m.Tiles,
+		Objects:    m.Objects,
+		Enemies:    m.Enemies,
+		Blocks:     m.Blocks,
+		Walls:      m.Walls,
+		Switches:   m.Switches,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+// WriteText writes a line-oriented text representation of a level,
+// with one line per tile, suitable for diffing.
+func WriteText(w io.Writer, m *Map) error {
+	_, err := fmt.Fprintf(w, "map name=%q author=%q width=%d height=%d background=%d\n",
+		m.Name, m.Author, m.Width, m.Height, m.Background)
+	if err != nil {
+		return err
+	}
+	for _, l := range m.Layers() {
+		for _, t := range l.Tiles {
+			if _, err := fmt.Fprintf(w, "%s %s\n", l.Name, formatTileText(t)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, name := range m.ExtraElem {
+		if _, err := fmt.Fprintf(w, "extra <%s>\n", name.Local); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatTileText(t Tile) string {
+	a := t.Attributes
+	s := fmt.Sprintf("(%d,%d) %d %q dir=%d image_index=%d flags=%#x category=%d",
+		t.X/64, t.Y/64, t.Type, a.Name, t.Direction, t.ImageIndex, a.Flags, a.EditorCategory)
+	if t.X%64 != 0 || t.Y%64 != 0 {
+		s += fmt.Sprintf(" pos=%d,%d", t.X, t.Y)
+	}
+	var extra []string
+	for _, attr := range t.Extra {
+		extra = append(extra, attr.Name.Local+"="+attr.Value)
+	}
+	for _, attr := range a.Extra {
+		extra = append(extra, attr.Name.Local+"="+attr.Value)
+	}
+	if len(extra) > 0 {
+		s += " " + strings.Join(extra, " ")
+	}
+	return s
+}
@@ -0,0 +1,56 @@
+package cc3d
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const roundTripLevel = `<?xml version="1.0" encoding="utf-8"?>
+<map author="someone" name="Round &amp; Round" height="2" width="2" background="3">
+  <player>
+    <tile image_index="0" x="0" y="0" direction="2" type="0">
+      <attributes flags="1" editor_category="0" name="Chip" />
+    </tile>
+  </player>
+  <tiles>
+    <tile image_index="1" x="0" y="0" direction="0" type="1">
+      <attributes flags="0" editor_category="1" name="Floor" map_char="." />
+    </tile>
+    <tile image_index="10" x="64" y="64" direction="1" type="10" speed="2">
+      <attributes flags="67657728" editor_category="1" name="Force Floor" colour="red" />
+    </tile>
+  </tiles>
+  <objects>
+    <tile image_index="38" x="64" y="0" direction="0" type="38">
+      <attributes flags="0" editor_category="2" name="Red Key" />
+    </tile>
+  </objects>
+  <enemies />
+  <blocks />
+  <walls />
+  <switches />
+</map>
+`
+
+func TestWriteLevelRoundTrip(t *testing.T) {
+	m, err := ReadLevel(strings.NewReader(roundTripLevel))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteLevel(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	m2, err := ReadLevel(&buf)
+	if err != nil {
+		t.Fatalf("reading written level: %v", err)
+	}
+	if !reflect.DeepEqual(m, m2) {
+		t.Errorf("level changed after writing it out:\n%+v\n%+v", m, m2)
+	}
+	if len(m2.Tiles) != 2 || len(m2.Tiles[1].Extra) != 1 || len(m2.Tiles[1].Attributes.Extra) != 1 {
+		t.Errorf("unknown attributes were not kept: %+v", m2.Tiles)
+	}
+}